@@ -6,10 +6,16 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
+	"time"
 )
 
-const borgCmd = "/usr/bin/borg"
+// The default borg program, found through PATH.
+const borgCmd = "borg"
+
+// MinVersion is the oldest version of borg supported.
+const MinVersion = "1.1.0"
 
 type Listing struct {
 	Archives []*Archive `json:"archives"`
@@ -24,28 +30,184 @@ type Archive struct {
 	Time     string `json:"time"`
 }
 
-func (a *Archive) GetName() (string, string, error) {
-	fields := strings.SplitN(a.Name, "-", 2)
-	if len(fields) != 2 {
-		return "", "", errors.New("Invalid archive name")
+// Archives are named by the volume and the snapshot they were made
+// from, separated by ArchiveDelimiter, which can't appear in volume
+// names (or in ZFS snapshot names).
+const ArchiveDelimiter = "@"
+
+// legacyDelimiter separated the volume and snapshot in the names of
+// archives made before ArchiveDelimiter was used.
+const legacyDelimiter = "-"
+
+// ArchiveName returns the name of the archive of the given snapshot
+// of a volume.
+func ArchiveName(volume, snap string) string {
+	return volume + ArchiveDelimiter + snap
+}
+
+// ValidVolume checks that a volume name can be used in archive names.
+func ValidVolume(volume string) error {
+	if volume == "" {
+		return errors.New("Volume name is empty")
+	}
+	if strings.Contains(volume, ArchiveDelimiter) {
+		return fmt.Errorf("Volume name %q contains %q", volume, ArchiveDelimiter)
+	}
+	return nil
+}
+
+// ParseArchiveName decodes the volume and snapshot from an archive
+// name.  Names made the old way, with a "-" between the volume and
+// the snapshot, are ambiguous, and are matched against the longest
+// of the given volume names that fits, and for which isSnap (if not
+// nil) accepts the rest of the name as a snapshot of that volume.
+// Returns false if the name isn't recognized.
+func ParseArchiveName(name string, volumes []string,
+	isSnap func(volume, snap string) bool) (volume, snap string, legacy, ok bool) {
+	if pos := strings.Index(name, ArchiveDelimiter); pos >= 0 {
+		volume, snap = name[:pos], name[pos+len(ArchiveDelimiter):]
+		if volume == "" || snap == "" {
+			return "", "", false, false
+		}
+		return volume, snap, false, true
 	}
 
-	return fields[0], fields[1], nil
+	for _, vol := range volumes {
+		prefix := vol + legacyDelimiter
+		if len(vol) <= len(volume) || !strings.HasPrefix(name, prefix) || len(name) == len(prefix) {
+			continue
+		}
+		if isSnap != nil && !isSnap(vol, name[len(prefix):]) {
+			continue
+		}
+		volume = vol
+	}
+	if volume == "" {
+		return "", "", false, false
+	}
+	return volume, name[len(volume)+len(legacyDelimiter):], true, true
+}
+
+// timeLayout is the layout of the times in borg's json output, which
+// are in local time.
+const timeLayout = "2006-01-02T15:04:05.000000"
+
+// GetTime returns the time the archive was made.
+func (a *Archive) GetTime() (time.Time, error) {
+	return time.ParseInLocation(timeLayout, a.Time, time.Local)
 }
 
 type Repo struct {
 	Path string
+
+	// Command is the borg program to run, defaulting to borgCmd.
+	// Args are given to every borg command, before the
+	// subcommand, and Env ("NAME=value") are added to the
+	// environment of every borg command.
+	Command string
+	Args    []string
+	Env     []string
+
+	// Passcommand is a command that prints the passphrase of the
+	// repository, and Passphrasefile a file containing it.  These,
+	// along with the location of the Keyfile, the Rsh command used
+	// to reach remote repositories, and the RemotePath of borg on
+	// the remote host, are given to borg through its environment,
+	// so that they don't appear on the command line.
+	Passcommand    string
+	Passphrasefile string
+	Keyfile        string
+	Rsh            string
+	RemotePath     string
+
+	// LockWait is how many seconds to wait for the repository
+	// lock, if non-zero.
+	LockWait int
+}
+
+// command builds a borg command with the given arguments.
+func (r *Repo) command(args ...string) *exec.Cmd {
+	cmd := exec.Command(r.program(), r.Args...)
+	if r.LockWait > 0 {
+		cmd.Args = append(cmd.Args, "--lock-wait", strconv.Itoa(r.LockWait))
+	}
+	cmd.Args = append(cmd.Args, args...)
+	if env := r.environ(); len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	return cmd
+}
+
+// program returns the borg program to run.
+func (r *Repo) program() string {
+	if r.Command == "" {
+		return borgCmd
+	}
+	return r.Command
+}
+
+// environ returns the variables to add to the environment of borg.
+// Later entries override earlier ones, and any already in gack's
+// environment.
+func (r *Repo) environ() []string {
+	env := append([]string{}, r.Env...)
+
+	// borg splits the passcommand like a shell, so the file name
+	// must be quoted.
+	if r.Passphrasefile != "" {
+		env = append(env, "BORG_PASSCOMMAND=cat "+shellQuote(r.Passphrasefile))
+	}
+	if r.Passcommand != "" {
+		env = append(env, "BORG_PASSCOMMAND="+r.Passcommand)
+	}
+	if r.Keyfile != "" {
+		env = append(env, "BORG_KEY_FILE="+r.Keyfile)
+	}
+	if r.Rsh != "" {
+		env = append(env, "BORG_RSH="+r.Rsh)
+	}
+	if r.RemotePath != "" {
+		env = append(env, "BORG_REMOTE_PATH="+r.RemotePath)
+	}
+
+	return env
+}
+
+// shellQuote quotes a string so that it is a single word to a shell.
+func shellQuote(text string) string {
+	return "'" + strings.Replace(text, "'", `'\''`, -1) + "'"
+}
+
+// Version returns the version of borg, such as "1.1.5".  Only the
+// program and environment are used, as Args are meant for commands
+// on the repository.
+func (r *Repo) Version() (string, error) {
+	cmd := exec.Command(r.program(), "--version")
+	if env := r.environ(); len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+
+	// The output is of the form "borg 1.1.5".
+	fields := strings.Fields(string(out))
+	if len(fields) != 2 {
+		return "", fmt.Errorf("Unexpected borg version output: %q", string(out))
+	}
+	return fields[1], nil
 }
 
 // GetSnapshots runs borg to determine the available snapshots.
 func (r *Repo) GetSnapshots() (*Listing, error) {
-	cmd := exec.Command(borgCmd, "list", "--json", r.Path)
+	cmd := r.command("list", "--json", r.Path)
 	cmd.Stderr = os.Stderr
 	out, err := cmd.Output()
 	if err != nil {
 		return nil, err
 	}
-	fmt.Printf("%d bytes of output\n", len(out))
 
 	var listing Listing
 	err = json.Unmarshal(out, &listing)
@@ -56,13 +218,156 @@ func (r *Repo) GetSnapshots() (*Listing, error) {
 	return &listing, nil
 }
 
-func (r *Repo) RunBackup(dir string, name string) error {
-	cmd := exec.Command(borgCmd, "create", "-s", "--progress",
-		"--one-file-system",
-		"--exclude-caches",
-		"--compression=lz4",
-		fmt.Sprintf("%s::%s", r.Path, name),
-		dir)
+// CreateOptions controls how "borg create" makes an archive.  The
+// zero value gives lz4 compression, and otherwise borg's defaults.
+type CreateOptions struct {
+	// Compression is the compression spec, such as "none" or
+	// "zstd,10".  Defaults to defaultCompression.
+	Compression string
+
+	// Exclude are patterns of paths to exclude, ExcludeFrom are
+	// files of exclude patterns, and PatternsFrom are files of
+	// include/exclude patterns.  ExcludeIfPresent excludes any
+	// directory containing a file of one of these names.
+	Exclude          []string
+	ExcludeFrom      []string
+	PatternsFrom     []string
+	ExcludeIfPresent []string
+
+	// ChunkerParams and FilesCache are passed to the
+	// --chunker-params and --files-cache options.
+	ChunkerParams string
+	FilesCache    string
+
+	// Nice, if non-zero, runs borg under nice with this
+	// adjustment.  IoniceClass, if non-zero, runs borg under
+	// ionice with this scheduling class (1 realtime, 2
+	// best-effort, 3 idle), and IoniceLevel, if given, is the
+	// priority within the class, from 0 (highest) to 7.
+	Nice        int
+	IoniceClass int
+	IoniceLevel *int
+
+	// Timestamp, if not zero, is recorded as the creation time of
+	// the archive, instead of the current time.
+	Timestamp time.Time
+}
+
+const defaultCompression = "lz4"
+
+// args returns the arguments to "borg create" for these options.
+func (o *CreateOptions) args() []string {
+	args := []string{"--one-file-system", "--exclude-caches"}
+
+	comp := o.Compression
+	if comp == "" {
+		comp = defaultCompression
+	}
+	args = append(args, "--compression="+comp)
+
+	for _, pat := range o.Exclude {
+		args = append(args, "--exclude", pat)
+	}
+	for _, file := range o.ExcludeFrom {
+		args = append(args, "--exclude-from", file)
+	}
+	for _, file := range o.PatternsFrom {
+		args = append(args, "--patterns-from", file)
+	}
+	for _, name := range o.ExcludeIfPresent {
+		args = append(args, "--exclude-if-present", name)
+	}
+	if o.ChunkerParams != "" {
+		args = append(args, "--chunker-params", o.ChunkerParams)
+	}
+	if o.FilesCache != "" {
+		args = append(args, "--files-cache", o.FilesCache)
+	}
+	if !o.Timestamp.IsZero() {
+		args = append(args, "--timestamp",
+			o.Timestamp.UTC().Format("2006-01-02T15:04:05"))
+	}
+
+	return args
+}
+
+// wrap runs the command under nice and ionice, as requested.
+func (o *CreateOptions) wrap(cmd *exec.Cmd) *exec.Cmd {
+	args := cmd.Args
+	if o.IoniceClass != 0 {
+		ionice := []string{"ionice", "-c", strconv.Itoa(o.IoniceClass)}
+		if o.IoniceLevel != nil {
+			ionice = append(ionice, "-n", strconv.Itoa(*o.IoniceLevel))
+		}
+		args = append(ionice, args...)
+	}
+	if o.Nice != 0 {
+		args = append([]string{"nice", "-n", strconv.Itoa(o.Nice)}, args...)
+	}
+	if len(args) == len(cmd.Args) {
+		return cmd
+	}
+
+	wrapped := exec.Command(args[0], args[1:]...)
+	wrapped.Env = cmd.Env
+	return wrapped
+}
+
+// RunBackup creates an archive of the given name from the contents of
+// dir.  Progress is passed to the progress function, if not nil, and
+// the statistics of the new archive are returned.
+func (r *Repo) RunBackup(dir string, name string, opts *CreateOptions,
+	progress func(*Progress)) (*Stats, error) {
+	cmd := r.command("create", "--log-json", "--json", "--progress")
+	cmd.Args = append(cmd.Args, opts.args()...)
+	cmd.Args = append(cmd.Args, fmt.Sprintf("%s::%s", r.Path, name), dir)
+	cmd = opts.wrap(cmd)
+
+	out, err := runLogJSON(cmd, progress)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseCreate(out)
+}
+
+// Delete removes an archive from the repository.
+func (r *Repo) Delete(name string) error {
+	cmd := r.command("delete", fmt.Sprintf("%s::%s", r.Path, name))
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return cmd.Run()
+}
+
+// Rename changes the name of an archive in the repository.
+func (r *Repo) Rename(name, newName string) error {
+	cmd := r.command("rename", fmt.Sprintf("%s::%s", r.Path, name), newName)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return cmd.Run()
+}
+
+// Check verifies the consistency of the repository and its archives.
+// If verifyData is true, the contents of every chunk are read and
+// verified as well, which reads the entire repository.
+func (r *Repo) Check(verifyData bool) error {
+	cmd := r.command("check")
+	if verifyData {
+		cmd.Args = append(cmd.Args, "--verify-data")
+	}
+	cmd.Args = append(cmd.Args, r.Path)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return cmd.Run()
+}
+
+// Compact frees the space in the repository from deleted archives.
+// This requires borg 1.2 or later.
+func (r *Repo) Compact() error {
+	cmd := r.command("compact", r.Path)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
@@ -0,0 +1,77 @@
+package borgcmd
+
+import (
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseArchiveName(t *testing.T) {
+	volumes := []string{"home", "home-media", "root"}
+
+	var tests = []struct {
+		name   string
+		volume string
+		snap   string
+		legacy bool
+		ok     bool
+	}{
+		{"home@hourly-201807041830", "home", "hourly-201807041830", false, true},
+		{"home-media@hourly-201807041830", "home-media", "hourly-201807041830", false, true},
+		{"other@daily-201807040000", "other", "daily-201807040000", false, true},
+		{"home-hourly-201807041830", "home", "hourly-201807041830", true, true},
+		{"home-media-hourly-201807041830", "home-media", "hourly-201807041830", true, true},
+		{"root-", "", "", false, false},
+		{"other-daily-201807040000", "", "", false, false},
+		{"@daily-201807040000", "", "", false, false},
+
+		// An unconfigured volume's archive isn't claimed by
+		// one whose name is a prefix of it.
+		{"home-videos-hourly-201807041830", "", "", false, false},
+	}
+
+	isSnap := func(volume, snap string) bool {
+		return strings.HasPrefix(snap, "hourly-") || strings.HasPrefix(snap, "daily-")
+	}
+	for _, tt := range tests {
+		volume, snap, legacy, ok := ParseArchiveName(tt.name, volumes, isSnap)
+		if volume != tt.volume || snap != tt.snap || legacy != tt.legacy || ok != tt.ok {
+			t.Errorf("%q: got %q, %q, %t, %t, want %q, %q, %t, %t", tt.name,
+				volume, snap, legacy, ok, tt.volume, tt.snap, tt.legacy, tt.ok)
+		}
+	}
+
+	name := ArchiveName("home-media", "hourly-201807041830")
+	volume, snap, _, ok := ParseArchiveName(name, nil, nil)
+	if !ok || volume != "home-media" || snap != "hourly-201807041830" {
+		t.Errorf("round trip %q: got %q, %q, %t", name, volume, snap, ok)
+	}
+
+	if ValidVolume("home@2") == nil {
+		t.Errorf("ValidVolume accepted a delimiter")
+	}
+}
+
+func TestWrap(t *testing.T) {
+	zero := 0
+	var tests = []struct {
+		opts CreateOptions
+		args []string
+	}{
+		{CreateOptions{}, []string{"borg", "create"}},
+		{CreateOptions{IoniceClass: 2},
+			[]string{"ionice", "-c", "2", "borg", "create"}},
+		{CreateOptions{IoniceClass: 2, IoniceLevel: &zero},
+			[]string{"ionice", "-c", "2", "-n", "0", "borg", "create"}},
+		{CreateOptions{Nice: 10, IoniceClass: 3},
+			[]string{"nice", "-n", "10", "ionice", "-c", "3", "borg", "create"}},
+	}
+
+	for _, tt := range tests {
+		cmd := tt.opts.wrap(exec.Command("borg", "create"))
+		if !reflect.DeepEqual(cmd.Args, tt.args) {
+			t.Errorf("wrap: got %q, want %q", cmd.Args, tt.args)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package borgcmd // import "davidb.org/x/gack/borgcmd"
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// Progress is reported periodically while borg creates an archive.
+type Progress struct {
+	OriginalSize     int64  `json:"original_size"`
+	CompressedSize   int64  `json:"compressed_size"`
+	DeduplicatedSize int64  `json:"deduplicated_size"`
+	Files            int64  `json:"nfiles"`
+	Path             string `json:"path"`
+}
+
+// Stats are the statistics of a newly created archive.
+// DeduplicatedSize is how much was added to the repository.
+type Stats struct {
+	Files            int64
+	OriginalSize     int64
+	CompressedSize   int64
+	DeduplicatedSize int64
+	Duration         time.Duration
+}
+
+// createResult is the subset of the output of "borg create --json"
+// we care about.
+type createResult struct {
+	Archive struct {
+		Duration float64 `json:"duration"`
+		Stats    struct {
+			OriginalSize     int64 `json:"original_size"`
+			CompressedSize   int64 `json:"compressed_size"`
+			DeduplicatedSize int64 `json:"deduplicated_size"`
+			Files            int64 `json:"nfiles"`
+		} `json:"stats"`
+	} `json:"archive"`
+}
+
+// A logLine is a line of output from borg's --log-json option.
+type logLine struct {
+	Type string `json:"type"`
+	Progress
+	Finished  bool   `json:"finished"`
+	LevelName string `json:"levelname"`
+	Message   string `json:"message"`
+}
+
+// runLogJSON runs a borg command that was given --log-json, passing
+// progress to the given function (if not nil), and log messages to
+// stderr.  Returns the command's standard output.
+func runLogJSON(cmd *exec.Cmd, progress func(*Progress)) ([]byte, error) {
+	var out bytes.Buffer
+	cmd.Stdout = &out
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	err = scanLogJSON(stderr, progress, os.Stderr)
+	if err != nil {
+		// Keep reading, so the command isn't blocked writing
+		// to the pipe.
+		io.Copy(ioutil.Discard, stderr)
+		cmd.Wait()
+		return nil, err
+	}
+
+	err = cmd.Wait()
+	if err != nil {
+		return nil, err
+	}
+
+	return out.Bytes(), nil
+}
+
+// scanLogJSON reads the --log-json output of borg, passing progress
+// to the given function (if not nil), and log messages, and anything
+// that isn't json, to log.
+func scanLogJSON(rd io.Reader, progress func(*Progress), log io.Writer) error {
+	scan := bufio.NewScanner(rd)
+	scan.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scan.Scan() {
+		var line logLine
+		if json.Unmarshal(scan.Bytes(), &line) != nil {
+			// Pass through anything that isn't json.
+			fmt.Fprintf(log, "%s\n", scan.Bytes())
+			continue
+		}
+
+		switch line.Type {
+		case "archive_progress":
+			if progress != nil && !line.Finished {
+				progress(&line.Progress)
+			}
+		case "log_message":
+			fmt.Fprintf(log, "borg %s: %s\n", line.LevelName, line.Message)
+		}
+	}
+	return scan.Err()
+}
+
+// parseCreate decodes the output of "borg create --json".
+func parseCreate(out []byte) (*Stats, error) {
+	var result createResult
+	err := json.Unmarshal(out, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	arch := &result.Archive
+	return &Stats{
+		Files:            arch.Stats.Files,
+		OriginalSize:     arch.Stats.OriginalSize,
+		CompressedSize:   arch.Stats.CompressedSize,
+		DeduplicatedSize: arch.Stats.DeduplicatedSize,
+		Duration:         time.Duration(arch.Duration * float64(time.Second)),
+	}, nil
+}
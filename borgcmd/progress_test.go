@@ -0,0 +1,95 @@
+package borgcmd
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Output recorded from "borg create --log-json --json --progress".
+const (
+	progressLine = `{"type": "archive_progress", "original_size": 2048, "compressed_size": 1024, "deduplicated_size": 512, "nfiles": 5, "path": "data/b", "time": 1530729000.0}`
+
+	finishedLine = `{"type": "archive_progress", "finished": true, "time": 1530729001.0}`
+
+	warningLine = `{"type": "log_message", "time": 1530729000.5, "message": "data/secret: [Errno 13] Permission denied: 'secret'", "levelname": "WARNING", "name": "borg.archiver"}`
+
+	createOutput = `{
+    "archive": {
+        "duration": 1.5,
+        "name": "home@hourly-201807041830",
+        "stats": {
+            "compressed_size": 1024,
+            "deduplicated_size": 512,
+            "nfiles": 10,
+            "original_size": 4096
+        }
+    },
+    "repository": {
+        "location": "/backup/borg"
+    }
+}`
+)
+
+func TestScanLogJSON(t *testing.T) {
+	var tests = []struct {
+		name     string
+		lines    []string
+		progress int
+		log      string
+	}{
+		{"progress", []string{progressLine, progressLine, finishedLine}, 2, ""},
+		{"warning", []string{progressLine, warningLine, finishedLine}, 1,
+			"borg WARNING: data/secret: [Errno 13] Permission denied: 'secret'\n"},
+		{"text", []string{"Remote: Warning: Permanently added 'host'", progressLine}, 1,
+			"Remote: Warning: Permanently added 'host'\n"},
+		{"empty", nil, 0, ""},
+	}
+
+	for _, tt := range tests {
+		var log bytes.Buffer
+		progress := 0
+		text := strings.Join(tt.lines, "\n")
+		err := scanLogJSON(strings.NewReader(text), func(p *Progress) {
+			progress++
+			want := Progress{OriginalSize: 2048, CompressedSize: 1024,
+				DeduplicatedSize: 512, Files: 5, Path: "data/b"}
+			if *p != want {
+				t.Errorf("%s: progress got %+v, want %+v", tt.name, p, want)
+			}
+		}, &log)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if progress != tt.progress {
+			t.Errorf("%s: progress called %d times, want %d", tt.name, progress, tt.progress)
+		}
+		if log.String() != tt.log {
+			t.Errorf("%s: log got %q, want %q", tt.name, log.String(), tt.log)
+		}
+	}
+}
+
+func TestParseCreate(t *testing.T) {
+	stats, err := parseCreate([]byte(createOutput))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Stats{
+		Files:            10,
+		OriginalSize:     4096,
+		CompressedSize:   1024,
+		DeduplicatedSize: 512,
+		Duration:         1500 * time.Millisecond,
+	}
+	if !reflect.DeepEqual(stats, want) {
+		t.Errorf("parseCreate: got %+v, want %+v", stats, want)
+	}
+
+	if _, err = parseCreate([]byte("not json")); err == nil {
+		t.Errorf("parseCreate accepted bad output")
+	}
+}
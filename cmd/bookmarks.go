@@ -0,0 +1,122 @@
+// Copyright © 2018 David Brown <davidb@davidb.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"davidb.org/x/gack/zfs"
+)
+
+// PruneBookmarks removes the bookmarks of this volume's convention
+// that are no longer needed.  Bookmarks are kept if they are within
+// the convention's BookmarkWithin of the current time, or if a clone
+// of this volume needs them as the base of its next incremental
+// send.  Bookmarks that don't belong to the convention are left
+// alone.
+func (v *SnapVolume) PruneBookmarks(conv *SnapConvention, now time.Time) error {
+	dss, err := zfs.GetSnaps(zfs.ParsePath(v.Zfs))
+	if err != nil {
+		return err
+	}
+	ds := dss[0]
+
+	bases, err := cloneBases(v.Zfs)
+	if err != nil {
+		return err
+	}
+
+	var removes []string
+	kept := 0
+	for _, book := range ds.Books {
+		tm, ok := conv.parseSnap(book)
+		if !ok {
+			tm, ok = conv.adoptSnap(book, nil)
+		}
+		if !ok {
+			continue
+		}
+
+		var reason string
+		if clone, ok := bases[book]; ok {
+			reason = fmt.Sprintf("base of clone %q", clone)
+		} else if conv.BookmarkWithin > 0 && tm.After(now.Add(-conv.BookmarkWithin)) {
+			reason = fmt.Sprintf("within %s", conv.BookmarkWithin)
+		}
+
+		if reason == "" {
+			removes = append(removes, book)
+			if pruneExplain {
+				fmt.Printf("  remove #%s\n", book)
+			}
+		} else {
+			kept++
+			if pruneExplain {
+				fmt.Printf("  keep   #%s %s\n", book, reason)
+			}
+		}
+	}
+
+	fmt.Printf("Bookmarks of %q: keep %d, prune %d\n", v.Zfs, kept, len(removes))
+
+	if pretend {
+		fmt.Printf("Would remove:\n")
+		for _, b := range removes {
+			fmt.Printf("    #%s\n", b)
+		}
+		return nil
+	}
+
+	for _, b := range removes {
+		fmt.Printf("   Remove #%s\n", b)
+	}
+	berr, ok := ds.RemoveBookmarks(removes).(zfs.BatchError)
+	if !ok {
+		return nil
+	}
+	for _, b := range removes {
+		if berr[b] != nil {
+			fmt.Printf("   Failed #%s: %s\n", b, berr[b])
+		}
+	}
+	return fmt.Errorf("Unable to remove %d of %d bookmarks of %q",
+		len(berr), len(removes), ds.Name)
+}
+
+// cloneBases returns the names of the snapshots that the clones of
+// the given volume will use as the base of their next incremental
+// send, mapped to the name of the clone.  This is the latest snapshot
+// at the clone's destination.
+func cloneBases(zfsName string) (map[string]string, error) {
+	bases := make(map[string]string)
+
+	for i := range GackConfig.Clone.Volumes {
+		cv := &GackConfig.Clone.Volumes[i]
+		if cv.Source != zfsName || cv.Skip {
+			continue
+		}
+
+		base, err := cv.LatestDest()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to query clone %q: %s", cv.Name, err)
+		}
+		if base != "" {
+			bases[base] = cv.Name
+		}
+	}
+
+	return bases, nil
+}
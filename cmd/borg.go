@@ -17,7 +17,6 @@ package cmd
 import (
 	"fmt"
 	"os"
-	"path/filepath"
 	"strings"
 
 	"davidb.org/x/gack/borgcmd"
@@ -39,11 +38,23 @@ config file.`,
 			fmt.Println(err)
 			os.Exit(1)
 		}
+		err = checkTools(true, false)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
 		fmt.Printf("pretend: %t\n", borgOptions.Pretend)
 		fmt.Printf("borg called: %v\n\n", &config)
 
 		for i := range config.Volumes {
 			fmt.Printf("Borg %q\n", config.Volumes[i].Name)
+			if borgOptions.Rename {
+				err = config.Volumes[i].RenameArchives()
+				if err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+			}
 			err = config.Volumes[i].Sync()
 			if err != nil {
 				fmt.Println(err)
@@ -56,11 +67,20 @@ config file.`,
 type BorgOptions struct {
 	Pretend bool
 	Limit   int
+	Rename  bool
 }
 
 var borgOptions BorgOptions
 
 type BorgConfig struct {
+	// Command is the borg program, found through PATH if not an
+	// absolute path.  Args are extra arguments given to every
+	// borg command, and Env ("NAME=value") adds to its
+	// environment.  These apply to all volumes.
+	Command string
+	Args    []string
+	Env     []string
+
 	Volumes []BorgVolume
 }
 
@@ -70,8 +90,45 @@ type BorgVolume struct {
 	Bind string
 	Repo string
 
+	// Retention gives which archives of this volume to keep in the
+	// borg repository.  Without any rules, archives are never
+	// removed.  Compact runs "borg compact" after removing
+	// archives, which needs borgCompactVersion.
+	Retention Retention
+	Compact   bool
+
+	// Create gives the options used when making archives, such
+	// as compression, excludes and nice levels.
+	Create borgcmd.CreateOptions
+
+	// Command overrides the global borg program for this volume.
+	// Args and Env are added to the global ones.
+	Command string
+	Args    []string
+	Env     []string
+
+	// Access to the repository.  The passphrase is given either by
+	// a Passcommand that prints it, or a Passphrasefile holding it.
+	// Keyfile is the location of the key for keyfile repositories,
+	// Rsh the ssh command for remote repositories, and RemotePath
+	// the borg program on the remote host.  LockWait is the number
+	// of seconds to wait for the repository lock.  Everything but
+	// LockWait is passed to borg in its environment.
+	Passcommand    string
+	Passphrasefile string
+	Keyfile        string
+	Rsh            string
+	RemotePath     string
+	LockWait       int
+
 	repo  *borgcmd.Repo
-	mount string
+	snaps SnapProvider
+
+	// backed holds the archives of this volume, as found by
+	// BackedSnaps.  unrecognized holds the archive names that have
+	// been reported as not belonging to the volume.
+	backed       []snapTime
+	unrecognized map[string]bool
 }
 
 func init() {
@@ -82,6 +139,8 @@ func init() {
 
 	borgCmd.Flags().IntVarP(&borgOptions.Limit, "limit", "l", 0,
 		"Limit the total number of backups to be run.")
+	borgCmd.Flags().BoolVar(&borgOptions.Rename, "rename", false,
+		"rename archives made with the old naming to the current naming")
 	// Here you will define your flags and configuration settings.
 
 	// Cobra supports Persistent Flags which will work for this command
@@ -95,75 +154,47 @@ func init() {
 
 var borgCount = 0
 
+// borgCompactVersion is the first version of borg with "borg compact".
+const borgCompactVersion = "1.2.0"
+
 // Sync attempts to catch up on any backups that need to be done
 // between snapshots and the borg volume.
 func (bv *BorgVolume) Sync() error {
-	path := zfs.ParsePath(bv.Zfs)
-	ds, err := zfs.GetSnaps(path)
-	if err != nil {
-		return err
-	}
-
-	bv.mount, err = FindMount(bv.Zfs, "zfs")
+	var err error
+	bv.snaps, err = OpenSnapProvider(bv.Zfs)
 	if err != nil {
 		return err
 	}
+	zsnaps := bv.snaps.Snaps()
 
-	fmt.Printf("%d zfs volumes\n", len(ds))
-	fmt.Printf("%d zfs snapshots\n", len(ds[0].Snaps))
-
-	bv.repo = &borgcmd.Repo{
-		Path: bv.Repo,
-	}
+	fmt.Printf("%d snapshots\n", len(zsnaps))
 
-	snaps, err := bv.repo.GetSnapshots()
+	todo, dropped, err := bv.toBackUp(zsnaps)
 	if err != nil {
 		return err
 	}
-	fmt.Printf("%d borg snapshots\n", len(snaps.Archives))
-
-	// Collect all of the tags that have been captured by
-	// snapshots.
-	backedSnaps := make(map[string]bool)
-	for _, snap := range snaps.Archives {
-		name, tag, err := snap.GetName()
-		if err != nil {
-			// Just skip the ones that are invalid.
-			continue
-		}
-		if bv.Name != name {
-			continue
-		}
-
-		backedSnaps[tag] = true
-	}
-
-	total := 0
-	for _, snap := range ds[0].Snaps {
-		if !backedSnaps[snap] {
-			total++
-		}
+	fmt.Printf("%d snapshots backed up in borg\n", len(bv.backed))
+	if dropped > 0 {
+		fmt.Printf("%d snapshots not backed up, as the retention would remove them\n",
+			dropped)
 	}
 
-	fmt.Printf("%d snapshots to sync to borg\n", total)
+	count := len(todo)
+	fmt.Printf("%d snapshots to sync to borg\n", count)
 
-	// Go through each ZFS snapshot and determine if it needs to
-	// be backed up.
-	// TODO: Handle child volumes better.
+	// Go through each snapshot that needs to be backed up.
+	var total backupStats
 	i := 0
-	for _, snap := range ds[0].Snaps {
-		if backedSnaps[snap] {
-			continue
-		}
-
+	for _, snap := range todo {
 		i++
 		fmt.Printf("-----------------------------------\n")
-		fmt.Printf("Backing borg %d of %d\n", i, total)
+		fmt.Printf("Backing borg %d of %d\n", i, count)
 		if !borgOptions.Pretend {
-			err = bv.SyncSingle(snap)
+			stats, err := bv.SyncSingle(snap)
 			if err != nil {
 				return err
 			}
+			total.add(stats)
 		} else {
 			fmt.Printf("Would back up %q:%q to %q\n", bv.Zfs, snap, bv.Repo)
 		}
@@ -177,30 +208,262 @@ func (bv *BorgVolume) Sync() error {
 		}
 	}
 
+	if total.Backups > 1 {
+		fmt.Printf("Total of %d backups: %s\n", total.Backups, &total)
+	}
+
 	return nil
 }
 
-func (bv *BorgVolume) SyncSingle(snap string) error {
+// SyncSingle backs up a single snapshot, returning the statistics of
+// the backup.
+func (bv *BorgVolume) SyncSingle(snap string) (*backupStats, error) {
 	fmt.Printf("Back up %q:%q to %q\n", bv.Zfs, snap, bv.Repo)
 
-	stat := filepath.Join(bv.mount, ".zfs", "snapshot", snap)
+	sn, err := bv.snaps.Materialize(snap, bv.Bind)
+	if err != nil {
+		return nil, err
+	}
+	defer sn.Release()
 
-	// It is important to stat within the snapshot so that the ZFS
-	// automounter will mount it.  We can't use filepath.Join,
-	// because it will ignore the addition of the ".".
-	_, err := os.Lstat(stat + "/.")
+	// Date the archive by when the snapshot was taken, rather than
+	// when it was backed up.
+	opts := bv.Create
+	opts.Timestamp = sn.Time
+
+	progress := newProgressLine()
+	bstats, err := bv.repo.RunBackup(sn.Dir, borgcmd.ArchiveName(bv.Name, snap),
+		&opts, progress.borg)
+	progress.done()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := borgStats(bstats)
+	fmt.Printf("Backed up %s\n", stats)
+	return stats, nil
+}
+
+// openRepo sets up the borg repository of this volume, combining the
+// global settings with the volume's, and checks that the borg
+// program is recent enough.
+func (bv *BorgVolume) openRepo() error {
+	global := &GackConfig.Borg
+
+	err := borgcmd.ValidVolume(bv.Name)
 	if err != nil {
 		return err
 	}
 
-	// Bind the mount to the desired Bind directory
-	mount, err := NewBindMount(stat, bv.Bind)
+	if bv.Passcommand != "" && bv.Passphrasefile != "" {
+		return fmt.Errorf("Borg %q: only one of passcommand and passphrasefile may be given",
+			bv.Name)
+	}
+
+	repo := &borgcmd.Repo{
+		Path:           bv.Repo,
+		Command:        global.Command,
+		Passcommand:    bv.Passcommand,
+		Passphrasefile: bv.Passphrasefile,
+		Keyfile:        bv.Keyfile,
+		Rsh:            bv.Rsh,
+		RemotePath:     bv.RemotePath,
+		LockWait:       bv.LockWait,
+	}
+	if bv.Command != "" {
+		repo.Command = bv.Command
+	}
+	repo.Args = append(append(repo.Args, global.Args...), bv.Args...)
+	repo.Env = append(append(repo.Env, global.Env...), bv.Env...)
+
+	if repo.Command == "" {
+		repo.Command = "borg"
+	}
+	err = checkVersion(repo.Command, borgcmd.MinVersion, repo.Version)
 	if err != nil {
 		return err
 	}
-	defer mount.Close()
 
-	return bv.repo.RunBackup(bv.Bind, bv.Name+"-"+snap)
+	bv.repo = repo
+	return nil
+}
+
+// BackedSnaps queries the borg repository, and returns the set of
+// snapshots of this volume that have been backed up.
+func (bv *BorgVolume) BackedSnaps() (map[string]bool, error) {
+	err := bv.openRepo()
+	if err != nil {
+		return nil, err
+	}
+
+	snaps, err := bv.repo.GetSnapshots()
+	if err != nil {
+		return nil, err
+	}
+
+	// Collect all of the tags that have been captured by
+	// snapshots, and the times of the archives.
+	backedSnaps := make(map[string]bool)
+	bv.backed = nil
+	for _, arch := range bv.archives(snaps) {
+		backedSnaps[arch.snap] = true
+
+		tm, err := arch.GetTime()
+		if err != nil {
+			continue
+		}
+		bv.backed = append(bv.backed, snapTime{Name: arch.Name, Time: tm})
+	}
+
+	return backedSnaps, nil
+}
+
+// toBackUp returns the snapshots, out of zsnaps (oldest first), that
+// need to be backed up, and the number left out because of the
+// volume's retention.  See pendingBackups.
+func (bv *BorgVolume) toBackUp(zsnaps []string) ([]string, int, error) {
+	backedSnaps, err := bv.BackedSnaps()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if bv.snaps == nil {
+		bv.snaps, err = OpenSnapProvider(bv.Zfs)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	times, err := bv.snaps.Times()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	todo, dropped := pendingBackups(zsnaps, times, backedSnaps, bv.backed, &bv.Retention)
+	return todo, dropped, nil
+}
+
+// A volumeArchive is an archive of a volume, along with the snapshot
+// it was made from.
+type volumeArchive struct {
+	*borgcmd.Archive
+	snap   string
+	legacy bool
+}
+
+// archives returns the archives in the listing that belong to this
+// volume, in the same order as the listing.
+func (bv *BorgVolume) archives(listing *borgcmd.Listing) []volumeArchive {
+	// Old archive names are matched against the volumes that
+	// share this repository.
+	var volumes []string
+	for i := range GackConfig.Borg.Volumes {
+		other := &GackConfig.Borg.Volumes[i]
+		if other.Repo == bv.Repo {
+			volumes = append(volumes, other.Name)
+		}
+	}
+	if len(volumes) == 0 {
+		volumes = []string{bv.Name}
+	}
+
+	var result []volumeArchive
+	for _, arch := range listing.Archives {
+		volume, snap, legacy, ok := borgcmd.ParseArchiveName(arch.Name, volumes, isLegacySnap)
+		if !ok {
+			bv.reportUnrecognized(arch.Name)
+			continue
+		}
+		if volume != bv.Name {
+			continue
+		}
+		result = append(result, volumeArchive{
+			Archive: arch,
+			snap:    snap,
+			legacy:  legacy,
+		})
+	}
+
+	return result
+}
+
+// isLegacySnap returns true if snap, from an old style archive name,
+// is a snapshot of one of the conventions used by the borg volume of
+// the given name.  If there are no conventions for that volume's ZFS
+// volume, any name is accepted, as there is nothing to check against.
+func isLegacySnap(volume, snap string) bool {
+	var zfsName string
+	for i := range GackConfig.Borg.Volumes {
+		if GackConfig.Borg.Volumes[i].Name == volume {
+			zfsName = GackConfig.Borg.Volumes[i].Zfs
+		}
+	}
+
+	checked := false
+	for i := range GackConfig.Snap.Volumes {
+		sv := &GackConfig.Snap.Volumes[i]
+		if sv.Zfs != zfsName {
+			continue
+		}
+		conv := findConvention(sv.Convention)
+		if conv == nil || conv.setup() != nil {
+			continue
+		}
+		checked = true
+		if _, ok := conv.parseSnap(snap); ok {
+			return true
+		}
+	}
+	return !checked
+}
+
+// reportUnrecognized reports, once, an old style archive name that
+// starts with this volume's name, but isn't one of its snapshots.
+// This is usually an archive of a volume that is no longer
+// configured.
+func (bv *BorgVolume) reportUnrecognized(name string) {
+	if strings.Contains(name, borgcmd.ArchiveDelimiter) ||
+		!strings.HasPrefix(name, bv.Name+"-") || bv.unrecognized[name] {
+		return
+	}
+	if bv.unrecognized == nil {
+		bv.unrecognized = make(map[string]bool)
+	}
+	bv.unrecognized[name] = true
+	fmt.Fprintf(pruneLog(), "Archive %q is not a snapshot of %q, ignoring\n", name, bv.Name)
+}
+
+// RenameArchives renames the archives of this volume that were named
+// the old way to the current naming.
+func (bv *BorgVolume) RenameArchives() error {
+	err := bv.openRepo()
+	if err != nil {
+		return err
+	}
+
+	listing, err := bv.repo.GetSnapshots()
+	if err != nil {
+		return err
+	}
+
+	for _, arch := range bv.archives(listing) {
+		if !arch.legacy {
+			continue
+		}
+
+		newName := borgcmd.ArchiveName(bv.Name, arch.snap)
+		if borgOptions.Pretend {
+			fmt.Printf("Would rename %s::%s to %s\n", bv.Repo, arch.Name, newName)
+			continue
+		}
+
+		fmt.Printf("Rename %s::%s to %s\n", bv.Repo, arch.Name, newName)
+		err = bv.repo.Rename(arch.Name, newName)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 // Prune compares the list of snapshots in the ZFS volume, and
@@ -222,8 +485,9 @@ func (bv *BorgVolume) Prune() error {
 	// 	fmt.Printf("  %#v\n", dd)
 	// }
 
-	bv.repo = &borgcmd.Repo{
-		Path: bv.Repo,
+	err = bv.openRepo()
+	if err != nil {
+		return err
 	}
 
 	snaps, err := bv.repo.GetSnapshots()
@@ -235,13 +499,9 @@ func (bv *BorgVolume) Prune() error {
 	// 	fmt.Printf("  %#v\n", bs)
 	// }
 
-	prefix := bv.Name + "-"
 	borgs := make(map[string]bool)
-	for _, bsnap := range snaps.Archives {
-		if !strings.HasPrefix(bsnap.Name, prefix) {
-			continue
-		}
-		borgs[bsnap.Name[len(prefix):]] = true
+	for _, arch := range bv.archives(snaps) {
+		borgs[arch.snap] = true
 	}
 	// fmt.Printf("Snaps: %#v\n", borgs)
 
@@ -268,23 +528,113 @@ func (bv *BorgVolume) Prune() error {
 
 	reverseStrings(removes)
 
+	// Other consumers of this volume may still need some of these.
+	// This volume's own pending snapshots are the ones being
+	// removed, so it doesn't hold any.
+	holds := consumerHolds(bv.Zfs, ds.Snaps, backupConsumer{"borg", bv.Name, bv}.String())
+	var unheld []string
+	for _, s := range removes {
+		if len(holds[s]) > 0 {
+			fmt.Printf("Held: %q by %s\n", s, strings.Join(holds[s], ", "))
+		} else {
+			unheld = append(unheld, s)
+		}
+	}
+	removes = unheld
+
 	if pretend {
 		fmt.Printf("Would remove:\n")
 		for _, s := range removes {
 			fmt.Printf("    %s\n", s)
 		}
 	} else {
+		err = removeSnaps(ds, removes, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// PruneArchives removes archives of this volume from the borg
+// repository, according to the volume's Retention.  The archives are
+// bucketed by their timestamps in the same way snapshots are.
+func (bv *BorgVolume) PruneArchives() error {
+	if bv.Retention == (Retention{}) {
+		return nil
+	}
+
+	err := bv.openRepo()
+	if err != nil {
+		return err
+	}
+
+	// Make sure compact will work before removing anything.
+	if bv.Compact {
+		err = checkVersion(bv.repo.Command, borgCompactVersion, bv.repo.Version)
+		if err != nil {
+			return fmt.Errorf("Borg %q: compact: %s", bv.Name, err)
+		}
+	}
+
+	listing, err := bv.repo.GetSnapshots()
+	if err != nil {
+		return err
+	}
+
+	// Borg lists the archives oldest first.
+	volArchives := bv.archives(listing)
+	var archives []snapTime
+	for i := len(volArchives) - 1; i >= 0; i-- {
+		arch := volArchives[i]
+
+		tm, err := arch.GetTime()
+		if err != nil {
+			fmt.Printf("Invalid time on archive %q: %s\n", arch.Name, err)
+			continue
+		}
+		archives = append(archives, snapTime{Name: arch.Name, Time: tm})
+	}
+
+	plan := bv.Retention.plan(archives)
+
+	// Never remove the newest archive.
+	if len(plan) > 0 && !plan[0].Keep {
+		plan[0].Keep = true
+		plan[0].Reasons = []string{"newest archive"}
+	}
+
+	keeps, removes := splitPlan(plan)
+
+	fmt.Printf("Borg %q policy: %s\n", bv.Name, bv.Retention)
+	fmt.Printf("Keep %d archives, prune %d\n", len(keeps), len(removes))
+
+	if pruneExplain {
+		explainPlan(plan)
+	}
+
+	if pretend {
+		fmt.Printf("Would remove:\n")
 		for _, s := range removes {
-			fmt.Printf("    Remove %s\n", s)
-			err = ds.Bookmark(s)
-			if err != nil {
-				return err
-			}
+			fmt.Printf("    %s::%s\n", bv.Repo, s)
+		}
+		return nil
+	}
 
-			err = ds.RemoveSnap(s)
-			if err != nil {
-				return err
-			}
+	for _, s := range removes {
+		fmt.Printf("    Remove %s::%s\n", bv.Repo, s)
+		err = bv.repo.Delete(s)
+		if err != nil {
+			return err
+		}
+	}
+
+	if bv.Compact && len(removes) > 0 {
+		fmt.Printf("Compact %s\n", bv.Repo)
+		err = bv.repo.Compact()
+		if err != nil {
+			return err
 		}
 	}
 
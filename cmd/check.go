@@ -0,0 +1,294 @@
+// Copyright © 2018 David Brown <davidb@davidb.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mitchellh/go-homedir"
+	"github.com/spf13/cobra"
+)
+
+// checkCmd represents the check command
+var checkCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Check the consistency of backup repositories",
+	Long: `Run "borg check" and "restic check" on each configured repository
+that is due to be checked.  A full check, which reads all of the data, is
+done every FullInterval, and a quicker check every Interval.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		err := checkTools(true, true)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
+		err = runChecks(&GackConfig.Check, repoChecks(), time.Now())
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	},
+}
+
+type CheckOptions struct {
+	Pretend bool
+	Force   bool
+	Full    bool
+}
+
+var checkOptions CheckOptions
+
+// CheckConfig controls how often the repositories are checked.
+// Quick checks are done every Interval, and full checks, that read
+// all of the data, every FullInterval.  A quick restic check also
+// reads one of ReadSubsets parts of the data, in rotation, so that
+// all of the data is read over that many checks (a ReadSubsets of 1
+// reads no data in quick checks).  The time of the
+// last successful checks is kept in StateFile.
+type CheckConfig struct {
+	Interval     time.Duration
+	FullInterval time.Duration
+	ReadSubsets  int
+	StateFile    string
+}
+
+const (
+	defaultCheckInterval     = 7 * 24 * time.Hour
+	defaultFullCheckInterval = 30 * 24 * time.Hour
+	defaultReadSubsets       = 10
+	defaultCheckStateFile    = ".gack-check.json"
+)
+
+// A checkState records the last successful checks of a single
+// repository.  Subset is the last data subset read by a quick
+// restic check.
+type checkState struct {
+	LastCheck time.Time
+	LastFull  time.Time
+	Subset    int
+}
+
+func init() {
+	RootCmd.AddCommand(checkCmd)
+
+	checkCmd.Flags().BoolVarP(&checkOptions.Pretend, "pretend", "n", false,
+		"show which repositories would be checked, but don't check them")
+	checkCmd.Flags().BoolVarP(&checkOptions.Force, "force", "f", false,
+		"check every repository, even if not due")
+	checkCmd.Flags().BoolVar(&checkOptions.Full, "full", false,
+		"do a full check, reading all of the data")
+}
+
+// A repoCheck is a single repository to be checked.  The check
+// function does a full check if full is true, and otherwise reads the
+// given subset of the data (if supported).
+type repoCheck struct {
+	key   string
+	check func(full bool, subset, subsets int) error
+}
+
+// repoChecks returns the repositories to check.  Repositories shared
+// by several volumes are only checked once.  A repository that can't
+// be opened is still returned, with a check that always fails, so
+// that it is reported along with the others.
+func repoChecks() []repoCheck {
+	var checks []repoCheck
+	seen := make(map[string]bool)
+
+	for i := range GackConfig.Borg.Volumes {
+		bv := &GackConfig.Borg.Volumes[i]
+		key := "borg:" + bv.Repo
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		err := bv.openRepo()
+		checks = append(checks, repoCheck{
+			key: key,
+			check: func(full bool, subset, subsets int) error {
+				if err != nil {
+					return err
+				}
+				return bv.repo.Check(full)
+			},
+		})
+	}
+
+	for i := range GackConfig.Restic.Volumes {
+		rv := &GackConfig.Restic.Volumes[i]
+		key := "restic:" + rv.Repo
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		err := rv.openRepo()
+		checks = append(checks, repoCheck{
+			key: key,
+			check: func(full bool, subset, subsets int) error {
+				if err != nil {
+					return err
+				}
+				part := ""
+				if subsets > 1 {
+					part = fmt.Sprintf("%d/%d", subset, subsets)
+				}
+				return rv.repo.Check(full, part)
+			},
+		})
+	}
+
+	return checks
+}
+
+// runChecks checks every repository that is due.  All repositories
+// are checked even if some fail, and an error is returned if any
+// failed.
+func runChecks(config *CheckConfig, checks []repoCheck, now time.Time) error {
+	interval := config.Interval
+	if interval == 0 {
+		interval = defaultCheckInterval
+	}
+	fullInterval := config.FullInterval
+	if fullInterval == 0 {
+		fullInterval = defaultFullCheckInterval
+	}
+	subsets := config.ReadSubsets
+	if subsets == 0 {
+		subsets = defaultReadSubsets
+	}
+
+	stateFile, err := config.stateFile()
+	if err != nil {
+		return err
+	}
+	states, err := loadCheckStates(stateFile)
+	if err != nil {
+		return err
+	}
+
+	var failed []string
+	for _, rc := range checks {
+		state := states[rc.key]
+		if state == nil {
+			state = &checkState{}
+		}
+
+		full := checkOptions.Full || now.Sub(state.LastFull) >= fullInterval
+		if !full && !checkOptions.Force && now.Sub(state.LastCheck) < interval {
+			fmt.Printf("Skip %s, last checked %s\n", rc.key,
+				state.LastCheck.Format("2006-01-02 15:04"))
+			continue
+		}
+
+		subset := state.Subset%subsets + 1
+		kind := "Check"
+		if full {
+			kind = "Full check"
+		} else if subsets > 1 {
+			kind = fmt.Sprintf("Check (data %d/%d)", subset, subsets)
+		}
+
+		if checkOptions.Pretend {
+			fmt.Printf("Would: %s %s\n", kind, rc.key)
+			continue
+		}
+
+		fmt.Printf("%s %s\n", kind, rc.key)
+		err = rc.check(full, subset, subsets)
+		if err != nil {
+			fmt.Printf("*** CHECK FAILED: %s: %s\n", rc.key, err)
+			failed = append(failed, rc.key)
+			continue
+		}
+
+		state.LastCheck = now
+		if full {
+			state.LastFull = now
+		} else {
+			state.Subset = subset
+		}
+		states[rc.key] = state
+
+		// Save after each check, so that an interruption doesn't
+		// lose the ones that succeeded.
+		err = saveCheckStates(stateFile, states)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%d repository checks failed: %v", len(failed), failed)
+	}
+	return nil
+}
+
+// stateFile returns the name of the file holding the check state,
+// which defaults to a file in the home directory.
+func (c *CheckConfig) stateFile() (string, error) {
+	if c.StateFile != "" {
+		return homedir.Expand(c.StateFile)
+	}
+
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, defaultCheckStateFile), nil
+}
+
+// loadCheckStates reads the check state file.  A missing file means
+// nothing has been checked.
+func loadCheckStates(name string) (map[string]*checkState, error) {
+	states := make(map[string]*checkState)
+
+	data, err := ioutil.ReadFile(name)
+	if os.IsNotExist(err) {
+		return states, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &states)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid check state %q: %s", name, err)
+	}
+	return states, nil
+}
+
+// saveCheckStates writes the check state file, replacing it
+// atomically.
+func saveCheckStates(name string, states map[string]*checkState) error {
+	data, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := name + ".tmp"
+	err = ioutil.WriteFile(tmp, append(data, '\n'), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, name)
+}
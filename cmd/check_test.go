@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRunChecks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gack-check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := &CheckConfig{
+		Interval:     7 * 24 * time.Hour,
+		FullInterval: 30 * 24 * time.Hour,
+		ReadSubsets:  3,
+		StateFile:    filepath.Join(dir, "state.json"),
+	}
+
+	// Each check records what it was asked to do.  The "bad"
+	// repository fails until fixed.
+	var calls []string
+	broken := true
+	check := func(key string) repoCheck {
+		return repoCheck{
+			key: key,
+			check: func(full bool, subset, subsets int) error {
+				if full {
+					calls = append(calls, key+" full")
+				} else {
+					calls = append(calls, fmt.Sprintf("%s %d/%d", key, subset, subsets))
+				}
+				if key == "bad" && broken {
+					return errors.New("corrupt")
+				}
+				return nil
+			},
+		}
+	}
+	checks := []repoCheck{check("good"), check("bad")}
+
+	start := time.Date(2018, 7, 4, 12, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+
+	var steps = []struct {
+		at     time.Duration
+		fix    bool
+		calls  []string
+		failed bool
+	}{
+		// Never checked, so both get a full check.
+		{0, false, []string{"good full", "bad full"}, true},
+		// Not due, but the failed one wasn't recorded.
+		{1 * day, false, []string{"bad full"}, true},
+		{2 * day, true, []string{"bad full"}, false},
+		{3 * day, false, nil, false},
+		// Quick checks rotate through the subsets.
+		{8 * day, false, []string{"good 1/3"}, false},
+		{9 * day, false, []string{"bad 1/3"}, false},
+		{16 * day, false, []string{"good 2/3", "bad 2/3"}, false},
+		{24 * day, false, []string{"good 3/3", "bad 3/3"}, false},
+		// Then a full check when that is due.
+		{31 * day, false, []string{"good full", "bad 1/3"}, false},
+		{32 * day, false, []string{"bad full"}, false},
+		{38 * day, false, []string{"good 1/3"}, false},
+	}
+
+	for _, st := range steps {
+		if st.fix {
+			broken = false
+		}
+		calls = nil
+		err := runChecks(config, checks, start.Add(st.at))
+		if (err != nil) != st.failed {
+			t.Errorf("day %d: error %v", st.at/day, err)
+		}
+		if !reflect.DeepEqual(calls, st.calls) {
+			t.Errorf("day %d: calls %q, want %q", st.at/day, calls, st.calls)
+		}
+	}
+}
@@ -115,6 +115,21 @@ func (cv *CloneVolume) CloneSync() error {
 	return nil
 }
 
+// LatestDest returns the name of the latest snapshot at the
+// destination, which will be the base of the next incremental clone.
+// Returns an empty string if the destination has no snapshots.
+func (cv *CloneVolume) LatestDest() (string, error) {
+	dlist, err := zfs.GetSnaps(zfs.ParsePath(cv.Dest))
+	if err != nil {
+		return "", err
+	}
+
+	if len(dlist) == 0 || len(dlist[0].Snaps) == 0 {
+		return "", nil
+	}
+	return dlist[0].Snaps[len(dlist[0].Snaps)-1], nil
+}
+
 // FreshClone performs an initial clone to where there is no
 // destination filesystem.  ZFS send doesn't seem to be able to send
 // the full list of incrementals on an initial scan, so only send the
@@ -0,0 +1,261 @@
+// Copyright © 2018 David Brown <davidb@davidb.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"davidb.org/x/gosure/store"
+)
+
+// A snapConsumer is something configured to make use of the
+// snapshots of a volume (a borg or restic backup, a surefile, or a
+// clone), and which may not have consumed all of them yet.
+type snapConsumer interface {
+	// Describe the consumer, for reporting which consumer is
+	// holding back a snapshot.
+	String() string
+
+	// Pending returns the snapshots, out of snaps (oldest first),
+	// that this consumer still needs.
+	Pending(snaps []string) (map[string]bool, error)
+}
+
+// findConsumers returns all of the configured consumers of the given
+// zfs volume.
+func findConsumers(zfsName string) []snapConsumer {
+	var result []snapConsumer
+
+	for i := range GackConfig.Borg.Volumes {
+		bv := &GackConfig.Borg.Volumes[i]
+		if bv.Zfs == zfsName {
+			result = append(result, backupConsumer{"borg", bv.Name, bv})
+		}
+	}
+
+	for i := range GackConfig.Restic.Volumes {
+		rv := &GackConfig.Restic.Volumes[i]
+		if rv.Zfs == zfsName {
+			result = append(result, backupConsumer{"restic", rv.Name, rv})
+		}
+	}
+
+	for i := range GackConfig.Sure.Volumes {
+		sv := &GackConfig.Sure.Volumes[i]
+		if sv.Zfs == zfsName {
+			result = append(result, sureConsumer{sv})
+		}
+	}
+
+	for i := range GackConfig.Clone.Volumes {
+		cv := &GackConfig.Clone.Volumes[i]
+		if cv.Source == zfsName && !cv.Skip {
+			result = append(result, cloneConsumer{cv})
+		}
+	}
+
+	return result
+}
+
+// consumerHolds returns, for each snapshot of the given volume that
+// is still needed by one of its consumers, the consumers that need
+// it.  If a consumer can't be queried, it holds all of the snapshots,
+// since there is no way to know which ones it still needs.  The
+// consumer described by except (if not empty) is ignored.
+func consumerHolds(zfsName string, snaps []string, except string) map[string][]string {
+	var consumers []snapConsumer
+	for _, cons := range findConsumers(zfsName) {
+		if cons.String() != except {
+			consumers = append(consumers, cons)
+		}
+	}
+	return holdsOf(consumers, snaps)
+}
+
+// holdsOf returns the snapshots held by each of the consumers.
+func holdsOf(consumers []snapConsumer, snaps []string) map[string][]string {
+	holds := make(map[string][]string)
+
+	for _, cons := range consumers {
+		pending, err := cons.Pending(snaps)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to query %s, holding all snapshots: %s\n",
+				cons, err)
+			pending = make(map[string]bool)
+			for _, sn := range snaps {
+				pending[sn] = true
+			}
+		}
+
+		for _, sn := range snaps {
+			if pending[sn] {
+				holds[sn] = append(holds[sn], cons.String())
+			}
+		}
+	}
+
+	return holds
+}
+
+// unconsumed returns the snapshots that have not been consumed.  Sure
+// goes back for any snapshot it hasn't seen, no matter how old, so
+// all of these are still needed.
+func unconsumed(snaps []string, consumed map[string]bool) map[string]bool {
+	pending := make(map[string]bool)
+	for _, sn := range snaps {
+		if !consumed[sn] {
+			pending[sn] = true
+		}
+	}
+	return pending
+}
+
+// pendingBackups returns the snapshots, out of zsnaps (oldest first),
+// that a backup still needs to make: those not in backed, other than
+// ones the retention would remove again at once, given the existing
+// backups.  The number of those left out is also returned.  Without
+// this, a backup removed by "prune --borg" or "prune --restic" would
+// be made again by the next sync, as long as something else keeps the
+// ZFS snapshot.
+func pendingBackups(zsnaps []string, times map[string]time.Time, backed map[string]bool,
+	existing []snapTime, retention *Retention) ([]string, int) {
+	var candidates []snapTime
+	for _, snap := range zsnaps {
+		if !backed[snap] {
+			candidates = append(candidates, snapTime{Name: snap, Time: times[snap]})
+		}
+	}
+	kept := retention.retained(existing, candidates)
+
+	var todo []string
+	for _, c := range candidates {
+		if kept[c.Name] {
+			todo = append(todo, c.Name)
+		}
+	}
+	return todo, len(candidates) - len(todo)
+}
+
+// A backupVolume is a borg or restic volume.
+type backupVolume interface {
+	toBackUp(zsnaps []string) ([]string, int, error)
+}
+
+// A backupConsumer is a borg or restic volume, as a consumer.
+type backupConsumer struct {
+	kind string
+	name string
+	vol  backupVolume
+}
+
+func (c backupConsumer) String() string {
+	return fmt.Sprintf("%s %q", c.kind, c.name)
+}
+
+// Pending returns the snapshots that the next sync of the volume will
+// back up.
+func (c backupConsumer) Pending(snaps []string) (map[string]bool, error) {
+	todo, _, err := c.vol.toBackUp(snaps)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := make(map[string]bool)
+	for _, sn := range todo {
+		pending[sn] = true
+	}
+	return pending, nil
+}
+
+type sureConsumer struct {
+	vol *SureVolume
+}
+
+func (c sureConsumer) String() string {
+	return fmt.Sprintf("sure %q", c.vol.Name)
+}
+
+// Pending returns the snapshots of the sure volume's convention that
+// haven't been scanned into the surefile.
+func (c sureConsumer) Pending(snaps []string) (map[string]bool, error) {
+	sv := c.vol
+
+	match, err := sv.matcher()
+	if err != nil {
+		return nil, err
+	}
+
+	var st store.Store
+	err = st.Parse(sv.Sure)
+	if err != nil {
+		return nil, err
+	}
+
+	host, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	st.Tags = map[string]string{
+		"host": host,
+		"zfs":  sv.Zfs,
+	}
+
+	// No header means nothing has been scanned yet.
+	hdr, _ := st.ReadHeader()
+
+	var mine []string
+	consumed := make(map[string]bool)
+	for _, sn := range snaps {
+		if !match(sn) {
+			continue
+		}
+		mine = append(mine, sn)
+		if hdr != nil && sv.ContainsSnap(&st, hdr, sn) {
+			consumed[sn] = true
+		}
+	}
+
+	return unconsumed(mine, consumed), nil
+}
+
+type cloneConsumer struct {
+	vol *CloneVolume
+}
+
+func (c cloneConsumer) String() string {
+	return fmt.Sprintf("clone %q", c.vol.Name)
+}
+
+// Pending returns the latest snapshot in common with the clone
+// destination, and all of the snapshots after it, which have yet to
+// be cloned.  Clones are incremental from the latest common snapshot,
+// so older snapshots are never needed.
+func (c cloneConsumer) Pending(snaps []string) (map[string]bool, error) {
+	base, err := c.vol.LatestDest()
+	if err != nil {
+		return nil, err
+	}
+
+	pending := make(map[string]bool)
+	for i := len(snaps) - 1; i >= 0; i-- {
+		pending[snaps[i]] = true
+		if snaps[i] == base {
+			break
+		}
+	}
+	return pending, nil
+}
@@ -0,0 +1,78 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testConsumer is a consumer that has consumed a fixed set of
+// snapshots.
+type testConsumer struct {
+	name     string
+	consumed map[string]bool
+}
+
+func (c testConsumer) String() string {
+	return c.name
+}
+
+func (c testConsumer) Pending(snaps []string) (map[string]bool, error) {
+	return unconsumed(snaps, c.consumed), nil
+}
+
+func TestConsumerHolds(t *testing.T) {
+	snaps := []string{"a", "b", "c", "d", "e"}
+
+	// A gap in the middle, which the consumer will go back for.
+	gap := testConsumer{
+		name:     "gap",
+		consumed: map[string]bool{"a": true, "b": true, "d": true},
+	}
+
+	// Consumed newest first, and only got the newest one so far.
+	newest := testConsumer{
+		name:     "newest",
+		consumed: map[string]bool{"e": true},
+	}
+
+	holds := holdsOf([]snapConsumer{gap, newest}, snaps)
+	want := map[string][]string{
+		"a": {"newest"},
+		"b": {"newest"},
+		"c": {"gap", "newest"},
+		"d": {"newest"},
+		"e": {"gap"},
+	}
+	if !reflect.DeepEqual(holds, want) {
+		t.Errorf("holds: got %v, want %v", holds, want)
+	}
+}
+
+func TestPendingBackups(t *testing.T) {
+	newest := time.Date(2018, 7, 4, 12, 0, 0, 0, time.UTC)
+	snaps := hourlySnaps(newest, 48)
+
+	times := make(map[string]time.Time)
+	for _, sn := range snaps {
+		times[sn.Name] = sn.Time
+	}
+
+	// Daily backups exist of the newest snapshot of each day.
+	existing := []snapTime{snaps[0], snaps[13]}
+	backed := map[string]bool{snaps[0].Name: true, snaps[13].Name: true}
+	zsnaps := []string{snaps[40].Name, snaps[14].Name, snaps[13].Name,
+		snaps[12].Name, snaps[1].Name, snaps[0].Name}
+
+	todo, dropped := pendingBackups(zsnaps, times, backed, existing, &Retention{Daily: 7})
+	want := []string{snaps[40].Name}
+	if !reflect.DeepEqual(todo, want) || dropped != 3 {
+		t.Errorf("pendingBackups: got %v, %d, want %v, 3", todo, dropped, want)
+	}
+
+	// Without any rules, everything not yet backed up is wanted.
+	todo, dropped = pendingBackups(zsnaps, times, backed, existing, &Retention{})
+	if len(todo) != 4 || dropped != 0 {
+		t.Errorf("no rules: got %v, %d", todo, dropped)
+	}
+}
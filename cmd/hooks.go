@@ -0,0 +1,130 @@
+// Copyright © 2018 David Brown <davidb@davidb.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// SnapHooks are shell commands run around the taking of a snapshot,
+// to allow applications (databases, VMs) to be quiesced so that the
+// snapshot is consistent.  Hooks can be given on the convention, and
+// on the volume.
+type SnapHooks struct {
+	// PreSnap is run before the snapshot is taken.  If it fails,
+	// the snapshot is not taken.
+	PreSnap string
+
+	// PostSnap is run after the snapshot, whether or not it, or
+	// the PreSnap hook, succeeded.
+	PostSnap string
+
+	// OnFailure is run if the PreSnap hook or the snapshot fails.
+	OnFailure string
+
+	// Timeout limits how long any one hook may run.  Defaults to
+	// defaultHookTimeout.
+	Timeout time.Duration
+}
+
+const defaultHookTimeout = 10 * time.Minute
+
+// A hookRunner runs the hooks for a single snapshot of a volume.
+type hookRunner struct {
+	vol  *SnapVolume
+	conv *SnapConvention
+	snap string
+}
+
+// pre runs the pre-snap hooks, the convention's first.
+func (h *hookRunner) pre() error {
+	for _, hk := range []*SnapHooks{&h.conv.Hooks, &h.vol.Hooks} {
+		err := h.run("pre-snap", hk, hk.PreSnap, nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// post runs the post-snap hooks, in the reverse order of the pre
+// hooks.  All hooks are run, and the first error is returned.
+func (h *hookRunner) post() error {
+	var first error
+	for _, hk := range []*SnapHooks{&h.vol.Hooks, &h.conv.Hooks} {
+		err := h.run("post-snap", hk, hk.PostSnap, nil)
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// failure runs the on-failure hooks.  Errors from these are only
+// reported, since there is already a failure to be returned.
+func (h *hookRunner) failure(cause error) {
+	for _, hk := range []*SnapHooks{&h.vol.Hooks, &h.conv.Hooks} {
+		err := h.run("on-failure", hk, hk.OnFailure, cause)
+		if err != nil {
+			fmt.Printf("Error: %s\n", err)
+		}
+	}
+}
+
+// run runs a single hook command with the shell.  The environment
+// describes the volume and snapshot being taken.
+func (h *hookRunner) run(kind string, hk *SnapHooks, command string, cause error) error {
+	if command == "" {
+		return nil
+	}
+
+	fmt.Printf("Run %s hook for %s@%s: %s\n", kind, h.vol.Zfs, h.snap, command)
+	if pretend {
+		return nil
+	}
+
+	timeout := hk.Timeout
+	if timeout <= 0 {
+		timeout = defaultHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", command)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		"GACK_HOOK="+kind,
+		"GACK_VOLUME="+h.vol.Name,
+		"GACK_CONVENTION="+h.conv.Name,
+		"GACK_ZFS="+h.vol.Zfs,
+		"GACK_SNAPSHOT="+h.snap)
+	if cause != nil {
+		cmd.Env = append(cmd.Env, "GACK_ERROR="+cause.Error())
+	}
+
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%s hook for %q timed out after %s", kind, h.vol.Name, timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("%s hook for %q failed: %s", kind, h.vol.Name, err)
+	}
+	return nil
+}
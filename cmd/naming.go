@@ -0,0 +1,239 @@
+// Copyright © 2018 David Brown <davidb@davidb.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Snapshot names are generated from a template in the convention.
+// The template can contain the following fields, which are replaced
+// with:
+//
+//	{convention}  the name of the convention
+//	{time}        the time of the snapshot, formatted with Layout
+//	{label}       the convention's Label
+//
+// The time is formatted in the convention's Zone, which is either
+// "UTC", "Local", or the name of a zone from the zoneinfo database.
+// To distinguish snapshots within the same minute, use a layout with
+// seconds, and for local zones, a layout with an offset ("-0700") to
+// keep the names unambiguous across daylight saving changes.  A zone
+// other than UTC is rejected if its names could be mistaken for the
+// legacy names below, which are always in UTC.
+const (
+	defaultTemplate = "{convention}-{time}"
+	defaultLayout   = "200601021504"
+	defaultZone     = "UTC"
+)
+
+// legacyLayout is the time layout of snapshot names made before
+// templates were configurable.
+const legacyLayout = "200601021504"
+
+// Snapshots made by other tools can be adopted by a convention, so
+// that prune will manage them.  Each entry in the convention's Adopt
+// list is either the name of one of the formats below, or "re:"
+// followed by a regular expression matching the whole snapshot name.
+// Snapshots whose name doesn't give a time (or matched by a regular
+// expression) use the snapshot's creation property instead.
+type adoptFormat struct {
+	re     *regexp.Regexp
+	layout string
+	local  bool
+}
+
+var adoptFormats = map[string]adoptFormat{
+	// zfs-auto-snapshot: zfs-auto-snap_hourly-2018-07-04-1830,
+	// in local time, or in UTC when run with --utc.
+	"zfs-auto-snap": {
+		re:     regexp.MustCompile(`^zfs-auto-snap_[\w-]+?-(\d{4}-\d{2}-\d{2}-\d{4})$`),
+		layout: "2006-01-02-1504",
+		local:  true,
+	},
+	"zfs-auto-snap-utc": {
+		re:     regexp.MustCompile(`^zfs-auto-snap_[\w-]+?-(\d{4}-\d{2}-\d{2}-\d{4})$`),
+		layout: "2006-01-02-1504",
+	},
+	// sanoid: autosnap_2018-07-04_18:30:01_hourly
+	"sanoid": {
+		re:     regexp.MustCompile(`^autosnap_(\d{4}-\d{2}-\d{2}_\d{2}:\d{2}:\d{2})_\w+$`),
+		layout: "2006-01-02_15:04:05",
+		local:  true,
+	},
+}
+
+// setup validates the naming parameters of this convention, and
+// compiles the pattern used to recognize its snapshots.
+func (c *SnapConvention) setup() error {
+	if c.re != nil {
+		return nil
+	}
+
+	if c.Template == "" {
+		c.Template = defaultTemplate
+	}
+	if c.Layout == "" {
+		c.Layout = defaultLayout
+	}
+	if c.Zone == "" {
+		c.Zone = defaultZone
+	}
+
+	loc, err := time.LoadLocation(c.Zone)
+	if err != nil {
+		return fmt.Errorf("Convention %q: %s", c.Name, err)
+	}
+
+	if strings.Count(c.Template, "{time}") != 1 {
+		return fmt.Errorf("Convention %q: template %q must contain {time} once",
+			c.Name, c.Template)
+	}
+
+	// Build the pattern from the template, quoting everything but
+	// the time.
+	pat := regexp.QuoteMeta(c.Template)
+	pat = strings.Replace(pat, regexp.QuoteMeta("{convention}"), regexp.QuoteMeta(c.Name), -1)
+	pat = strings.Replace(pat, regexp.QuoteMeta("{label}"), regexp.QuoteMeta(c.Label), -1)
+	pat = strings.Replace(pat, regexp.QuoteMeta("{time}"), `(.+)`, 1)
+
+	c.adopts = nil
+	for _, name := range c.Adopt {
+		if strings.HasPrefix(name, "re:") {
+			re, err := regexp.Compile("^(?:" + name[3:] + ")$")
+			if err != nil {
+				return fmt.Errorf("Convention %q: adopt: %s", c.Name, err)
+			}
+			c.adopts = append(c.adopts, adoptFormat{re: re})
+			continue
+		}
+
+		format, ok := adoptFormats[name]
+		if !ok {
+			return fmt.Errorf("Convention %q: unknown adopt format %q", c.Name, name)
+		}
+		c.adopts = append(c.adopts, format)
+	}
+
+	re := regexp.MustCompile("^" + pat + "$")
+	if loc != time.UTC {
+		sample := c.Name + "-" + time.Time{}.Format(legacyLayout)
+		if m := re.FindStringSubmatch(sample); m != nil {
+			if _, err := time.ParseInLocation(c.Layout, m[1], loc); err == nil {
+				return fmt.Errorf("Convention %q: zone %q needs a layout with an offset, or a different template",
+					c.Name, c.Zone)
+			}
+		}
+	}
+
+	c.loc = loc
+	c.re = re
+	c.legacyRe = regexp.MustCompile("^" + regexp.QuoteMeta(c.Name) + `(\d*)-(\d{12})$`)
+	return nil
+}
+
+// snapName returns the name of a snapshot taken at the given time.
+func (c *SnapConvention) snapName(now time.Time) string {
+	c.mustSetup()
+
+	r := strings.NewReplacer(
+		"{convention}", c.Name,
+		"{label}", c.Label,
+		"{time}", now.In(c.loc).Format(c.Layout))
+	return r.Replace(c.Template)
+}
+
+// parseSnap decodes the time from the name of a snapshot made with
+// this convention.  Returns false if the name isn't one of this
+// convention's snapshots.  Names made before the naming was
+// configurable are also recognized.
+func (c *SnapConvention) parseSnap(name string) (time.Time, bool) {
+	c.mustSetup()
+
+	if m := c.re.FindStringSubmatch(name); m != nil {
+		tm, err := time.ParseInLocation(c.Layout, m[1], c.loc)
+		if err == nil {
+			return tm, true
+		}
+	}
+
+	if m := c.legacyRe.FindStringSubmatch(name); m != nil {
+		tm, err := time.Parse(legacyLayout, m[2])
+		if err == nil {
+			return tm.In(c.loc), true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// adoptSnap decodes the time of a snapshot made by another tool,
+// which matches one of the formats this convention adopts.  The
+// created map gives the creation time of the snapshots, for names
+// that don't contain one.  Returns false if the snapshot isn't
+// adopted.
+func (c *SnapConvention) adoptSnap(name string, created map[string]time.Time) (time.Time, bool) {
+	c.mustSetup()
+
+	for _, format := range c.adopts {
+		m := format.re.FindStringSubmatch(name)
+		if m == nil {
+			continue
+		}
+
+		if format.layout != "" {
+			loc := time.UTC
+			if format.local {
+				loc = time.Local
+			}
+			tm, err := time.ParseInLocation(format.layout, m[1], loc)
+			if err == nil {
+				return tm.In(c.loc), true
+			}
+		}
+
+		tm, ok := created[name]
+		if ok {
+			return tm.In(c.loc), true
+		}
+		return time.Time{}, false
+	}
+
+	return time.Time{}, false
+}
+
+// mustSetup sets up the convention, which should have already been
+// validated by setup.
+func (c *SnapConvention) mustSetup() {
+	err := c.setup()
+	if err != nil {
+		panic(err)
+	}
+}
+
+// findConvention returns the snapshot convention of the given name,
+// or nil if there is no such convention.
+func findConvention(name string) *SnapConvention {
+	convs := GackConfig.Snap.Conventions
+	for i := range convs {
+		if convs[i].Name == name {
+			return &convs[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSnapNaming(t *testing.T) {
+	now := time.Date(2018, 7, 4, 18, 30, 15, 0, time.UTC)
+
+	var tests = []struct {
+		conv SnapConvention
+		name string
+		tm   time.Time
+	}{
+		{
+			conv: SnapConvention{Name: "hourly"},
+			name: "hourly-201807041830",
+			tm:   now.Truncate(time.Minute),
+		},
+		{
+			conv: SnapConvention{
+				Name:     "hourly",
+				Template: "{label}{convention}-{time}",
+				Layout:   "2006-01-02T150405-0700",
+				Zone:     "America/Denver",
+				Label:    "db-",
+			},
+			name: "db-hourly-2018-07-04T123015-0600",
+			tm:   now,
+		},
+		{
+			// Legacy names also match this template, and
+			// must still be read as UTC.
+			conv: SnapConvention{
+				Name:   "hourly",
+				Layout: "200601021504-0700",
+				Zone:   "America/Los_Angeles",
+			},
+			name: "hourly-201807041130-0700",
+			tm:   now.Truncate(time.Minute),
+		},
+	}
+
+	for _, tt := range tests {
+		conv := tt.conv
+		if err := conv.setup(); err != nil {
+			t.Fatal(err)
+		}
+
+		name := conv.snapName(now)
+		if name != tt.name {
+			t.Errorf("snapName: got %q, want %q", name, tt.name)
+		}
+
+		tm, ok := conv.parseSnap(name)
+		if !ok || !tm.Equal(tt.tm) {
+			t.Errorf("parseSnap(%q): got %s, %t, want %s", name, tm, ok, tt.tm)
+		}
+
+		// Names from before templates must still be recognized.
+		tm, ok = conv.parseSnap("hourly-201807041830")
+		if !ok || !tm.Equal(now.Truncate(time.Minute)) {
+			t.Errorf("legacy parseSnap: got %s, %t", tm, ok)
+		}
+
+		if _, ok = conv.parseSnap("daily-201807041830"); ok {
+			t.Errorf("parseSnap matched another convention")
+		}
+	}
+}
+
+func TestSnapNamingZone(t *testing.T) {
+	// Without an offset, a local name can't be told apart from a
+	// legacy UTC one.
+	conv := SnapConvention{Name: "hourly", Zone: "America/Los_Angeles"}
+	if err := conv.setup(); err == nil {
+		t.Errorf("setup accepted a local zone with legacy-like names")
+	}
+
+	// A template that legacy names can't match is fine.
+	conv = SnapConvention{
+		Name:     "hourly",
+		Template: "{convention}-local-{time}",
+		Zone:     "America/Los_Angeles",
+	}
+	if err := conv.setup(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAdoptSnap(t *testing.T) {
+	conv := SnapConvention{
+		Name:  "hourly",
+		Adopt: []string{"zfs-auto-snap"},
+	}
+	if err := conv.setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := time.Date(2018, 7, 4, 18, 30, 0, 0, time.Local)
+	tm, ok := conv.adoptSnap("zfs-auto-snap_hourly-2018-07-04-1830", nil)
+	if !ok || !tm.Equal(want) {
+		t.Errorf("zfs-auto-snap: got %s, %t, want %s", tm, ok, want)
+	}
+
+	conv = SnapConvention{
+		Name:  "hourly",
+		Adopt: []string{"zfs-auto-snap-utc"},
+	}
+	if err := conv.setup(); err != nil {
+		t.Fatal(err)
+	}
+
+	want = time.Date(2018, 7, 4, 18, 30, 0, 0, time.UTC)
+	tm, ok = conv.adoptSnap("zfs-auto-snap_hourly-2018-07-04-1830", nil)
+	if !ok || !tm.Equal(want) {
+		t.Errorf("zfs-auto-snap-utc: got %s, %t, want %s", tm, ok, want)
+	}
+}
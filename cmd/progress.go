@@ -0,0 +1,138 @@
+// Copyright © 2018 David Brown <davidb@davidb.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"davidb.org/x/gack/borgcmd"
+	"davidb.org/x/gack/resticcmd"
+)
+
+// backupStats summarize one or more backups, in the same terms for
+// borg and restic.  Bytes is the size of the data backed up, and
+// Added how much was stored in the repository after deduplication
+// and compression.  Errors counts the files that couldn't be backed
+// up.
+type backupStats struct {
+	Backups  int
+	Files    int64
+	Bytes    int64
+	Added    int64
+	Errors   int
+	Duration time.Duration
+}
+
+func borgStats(s *borgcmd.Stats) *backupStats {
+	return &backupStats{
+		Backups:  1,
+		Files:    s.Files,
+		Bytes:    s.OriginalSize,
+		Added:    s.DeduplicatedSize,
+		Duration: s.Duration,
+	}
+}
+
+func resticStats(s *resticcmd.Stats) *backupStats {
+	return &backupStats{
+		Backups:  1,
+		Files:    s.TotalFilesProcessed,
+		Bytes:    s.TotalBytesProcessed,
+		Added:    s.DataAdded,
+		Errors:   len(s.Errors),
+		Duration: s.Duration,
+	}
+}
+
+// add accumulates other into these stats.
+func (s *backupStats) add(other *backupStats) {
+	s.Backups += other.Backups
+	s.Files += other.Files
+	s.Bytes += other.Bytes
+	s.Added += other.Added
+	s.Errors += other.Errors
+	s.Duration += other.Duration
+}
+
+// ratio returns the ratio of the data backed up to what was added.
+func (s *backupStats) ratio() float64 {
+	if s.Added == 0 {
+		return 0
+	}
+	return float64(s.Bytes) / float64(s.Added)
+}
+
+func (s *backupStats) String() string {
+	text := fmt.Sprintf("%d files, %s, added %s (ratio %.1f), %s",
+		s.Files, formatSize(s.Bytes), formatSize(s.Added), s.ratio(),
+		s.Duration.Round(time.Second))
+	if s.Errors > 0 {
+		text += fmt.Sprintf(", %d files could not be read", s.Errors)
+	}
+	return text
+}
+
+// A progressLine shows the progress of a backup on a single line of
+// the terminal, which is rewritten as the backup proceeds.  Nothing
+// is shown if stdout isn't a terminal.
+type progressLine struct {
+	enabled bool
+	shown   bool
+	last    time.Time
+}
+
+func newProgressLine() *progressLine {
+	return &progressLine{enabled: isTerminal(os.Stdout)}
+}
+
+// update shows the number of files and bytes processed so far.  If
+// percent is not negative, it is shown as well.
+func (p *progressLine) update(files, bytes int64, percent float64) {
+	if !p.enabled {
+		return
+	}
+
+	// Limit how often the line is redrawn.
+	now := time.Now()
+	if now.Sub(p.last) < 200*time.Millisecond {
+		return
+	}
+	p.last = now
+
+	line := fmt.Sprintf("%d files, %s", files, formatSize(bytes))
+	if percent >= 0 {
+		line = fmt.Sprintf("%5.1f%% %s", percent*100, line)
+	}
+	fmt.Printf("\r%s\033[K", line)
+	p.shown = true
+}
+
+func (p *progressLine) borg(prog *borgcmd.Progress) {
+	p.update(prog.Files, prog.OriginalSize, -1)
+}
+
+func (p *progressLine) restic(prog *resticcmd.Progress) {
+	p.update(prog.FilesDone, prog.BytesDone, prog.PercentDone)
+}
+
+// done finishes the progress line, so that other output can follow.
+func (p *progressLine) done() {
+	if p.shown {
+		fmt.Printf("\r\033[K")
+		p.shown = false
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright © 2018 David Brown <davidb@davidb.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"davidb.org/x/gack/zfs"
+)
+
+// A SnapProvider gives the backup consumers (borg, restic, sure)
+// access to the snapshots of a single volume, without them needing
+// to know what technology made the snapshots.
+type SnapProvider interface {
+	// Snaps returns the names of the snapshots of this volume,
+	// oldest first.
+	Snaps() []string
+
+	// Times returns when each of the snapshots was taken.
+	Times() (map[string]time.Time, error)
+
+	// Materialize makes the named snapshot readable.  If dest is
+	// not empty, the snapshot will be made visible at that
+	// directory, otherwise it is left wherever the provider
+	// naturally exposes it.  The caller must Release the result.
+	Materialize(snap, dest string) (*Snapshot, error)
+}
+
+// A Snapshot is a snapshot that has been materialized, and whose
+// contents can be read under Dir.  Time is when the snapshot was
+// taken, or zero if the provider doesn't know.
+type Snapshot struct {
+	Dir     string
+	Time    time.Time
+	release func() error
+}
+
+// Release undoes whatever was needed to materialize the snapshot.
+func (s *Snapshot) Release() error {
+	if s.release == nil {
+		return nil
+	}
+	return s.release()
+}
+
+// OpenSnapProvider returns the provider for the volume described by
+// name.  Currently, all volumes are ZFS filesystems.
+func OpenSnapProvider(name string) (SnapProvider, error) {
+	return NewZfsProvider(name)
+}
+
+// A ZfsProvider provides snapshots from a ZFS filesystem.  Only the
+// snapshots of the top filesystem are provided.
+type ZfsProvider struct {
+	Zfs      string
+	DataSets []*zfs.DataSet
+
+	mount string
+	times map[string]time.Time
+}
+
+// NewZfsProvider queries the snapshots of the given zfs filesystem.
+// The name is parsed with zfs.ParsePath.
+func NewZfsProvider(name string) (*ZfsProvider, error) {
+	dss, err := zfs.GetSnaps(zfs.ParsePath(name))
+	if err != nil {
+		return nil, err
+	}
+
+	return &ZfsProvider{
+		Zfs:      name,
+		DataSets: dss,
+	}, nil
+}
+
+// DataSet returns the top-level dataset of this provider.
+func (p *ZfsProvider) DataSet() *zfs.DataSet {
+	return p.DataSets[0]
+}
+
+// Snaps returns the snapshots of the top-level dataset.
+// TODO: Handle child volumes better.
+func (p *ZfsProvider) Snaps() []string {
+	return p.DataSet().Snaps
+}
+
+// Times returns the creation time of each snapshot of the top-level
+// dataset.
+func (p *ZfsProvider) Times() (map[string]time.Time, error) {
+	if p.times == nil {
+		times, err := p.DataSet().SnapTimes()
+		if err != nil {
+			return nil, err
+		}
+		p.times = times
+	}
+	return p.times, nil
+}
+
+// Materialize makes a ZFS snapshot available through the
+// filesystem's .zfs/snapshot directory, and, if requested, binds it
+// to the dest directory.  The time of the snapshot is its creation
+// property.
+func (p *ZfsProvider) Materialize(snap, dest string) (*Snapshot, error) {
+	if p.mount == "" {
+		mount, err := FindMount(p.Zfs, "zfs")
+		if err != nil {
+			return nil, err
+		}
+		p.mount = mount
+	}
+
+	dir := filepath.Join(p.mount, ".zfs", "snapshot", snap)
+
+	// It is important to stat within the snapshot so that the ZFS
+	// automounter will mount it.  We can't use filepath.Join,
+	// because it will ignore the addition of the ".".
+	_, err := os.Lstat(dir + "/.")
+	if err != nil {
+		return nil, err
+	}
+
+	times, err := p.Times()
+	if err != nil {
+		return nil, err
+	}
+
+	if dest == "" {
+		return &Snapshot{Dir: dir, Time: times[snap]}, nil
+	}
+
+	// Bind the mount to the desired directory.
+	mount, err := NewBindMount(dir, dest)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to bind %q to %q: %s", dir, dest, err)
+	}
+
+	return &Snapshot{
+		Dir:     dest,
+		Time:    times[snap],
+		release: mount.Close,
+	}, nil
+}
@@ -15,9 +15,13 @@
 package cmd
 
 import (
+	"bufio"
+	"encoding/json"
 	"fmt"
+	"io"
 	"os"
-	"regexp"
+	"sort"
+	"strings"
 	"time"
 
 	"davidb.org/x/gack/zfs"
@@ -31,6 +35,14 @@ var pruneCmd = &cobra.Command{
 	Short: "Prune ",
 	Long:  `Prune any expired backups based on the policy given.`,
 	Run: func(cmd *cobra.Command, args []string) {
+		// Pruning snapshots asks the backups which they still
+		// need, so uses both programs.
+		err := checkTools(!pruneRestic && !pruneBookmarks, !pruneBorg && !pruneBookmarks)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+
 		if pruneBorg {
 			var config BorgConfig
 			err := viper.UnmarshalKey("borg", &config)
@@ -40,28 +52,79 @@ var pruneCmd = &cobra.Command{
 			}
 
 			for i := range config.Volumes {
+				err = config.Volumes[i].PruneArchives()
+				if err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+
 				err = config.Volumes[i].Prune()
 				if err != nil {
 					fmt.Println(err)
 					os.Exit(1)
 				}
 			}
+		} else if pruneRestic {
+			for i := range GackConfig.Restic.Volumes {
+				err := GackConfig.Restic.Volumes[i].Forget()
+				if err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+			}
+		} else if pruneBookmarks {
+			now := time.Now()
+			snapPruneCmd(func(vol *SnapVolume, conv *SnapConvention) error {
+				return vol.PruneBookmarks(conv, now)
+			})
 		} else {
+			if pruneJSON {
+				pretend = true
+			}
 			snapPruneCmd(func(vol *SnapVolume, conv *SnapConvention) error {
 				return vol.Prune(conv)
 			})
+
+			// All of the volumes are written as a single
+			// document.
+			if pruneJSON {
+				enc := json.NewEncoder(os.Stdout)
+				enc.SetIndent("", "  ")
+				err := enc.Encode(pruneReports)
+				if err != nil {
+					fmt.Println(err)
+					os.Exit(1)
+				}
+			}
 		}
 	},
 }
 
-var pruneBorg bool
+var (
+	pruneBorg      bool
+	pruneExplain   bool
+	pruneJSON      bool
+	pruneForce     bool
+	pruneBookmarks bool
+	pruneRestic    bool
+)
 
 func init() {
 	RootCmd.AddCommand(pruneCmd)
 	pruneCmd.Flags().BoolVarP(&pretend, "pretend", "n", false,
 		"show what would have been executed, but don't actually run")
 	pruneCmd.Flags().BoolVarP(&pruneBorg, "borg", "b", false,
-		"Prune volumes, other than latest, that have been removed from borg")
+		"Prune borg archives by retention, then volumes, other than latest, that have been removed from borg")
+	pruneCmd.Flags().BoolVarP(&pruneExplain, "explain", "e", false,
+		"explain why each snapshot is kept or removed")
+	pruneCmd.Flags().BoolVar(&pruneJSON, "json", false,
+		"write the explanation as JSON, without removing anything")
+	pruneCmd.Flags().BoolVarP(&pruneForce, "force", "f", false,
+		"remove snapshots even if beyond the convention's safety limits")
+	pruneCmd.Flags().BoolVar(&pruneBookmarks, "bookmarks", false,
+		"Prune bookmarks no longer needed by clones or the convention")
+	pruneCmd.Flags().BoolVarP(&pruneRestic, "restic", "r", false,
+		"Forget restic snapshots by each volume's retention")
 }
 
 func (v *SnapVolume) Prune(conv *SnapConvention) error {
@@ -74,96 +137,564 @@ func (v *SnapVolume) Prune(conv *SnapConvention) error {
 
 	ds := dss[0]
 
-	fmt.Printf("Need to look through %d snapshots\n", len(ds.Snaps))
-
-	// Go through each snapshot trying to decode a name from it
-	// that matches the given pattern
-	re := regexp.MustCompile("^" + regexp.QuoteMeta(conv.Name) + `(\d*)-(\d+)$`)
-
-	var buckets = [6]struct {
-		Count  int
-		bucker func(d time.Time, nr int) int
-		Last   int
-	}{
-		{conv.Last, always, -1},
-		{conv.Hourly, ymdh, -1},
-		{conv.Daily, ymd, -1},
-		{conv.Weekly, yw, -1},
-		{conv.Monthly, ym, -1},
-		{conv.Yearly, y, -1},
+	if !pruneJSON {
+		fmt.Printf("Need to look through %d snapshots\n", len(ds.Snaps))
 	}
 
-	var keeps []string
-	var removes []string
+	// Snapshots adopted from other tools may need their creation
+	// time.
+	var created map[string]time.Time
+	if len(conv.Adopt) > 0 {
+		created, err = ds.SnapTimes()
+		if err != nil {
+			return err
+		}
+	}
 
 	// The snapshots are returned in order, the pruning wants them
 	// in the reverse order, so just build it that way.
-	rsnaps := make([]string, 0, len(ds.Snaps))
+	var snaps []snapTime
 	for i := len(ds.Snaps); i > 0; i-- {
-		rsnaps = append(rsnaps, ds.Snaps[i-1])
+		sn := ds.Snaps[i-1]
+
+		// Skip snapshots that don't belong to this convention.
+		tm, ok := conv.parseSnap(sn)
+		if !ok {
+			tm, ok = conv.adoptSnap(sn, created)
+		}
+		if !ok {
+			continue
+		}
+
+		snaps = append(snaps, snapTime{Name: sn, Time: tm})
 	}
 
-	for nr, sn := range rsnaps {
-		var keepSnap bool
+	policy := conv.Retention.override(&v.Retention)
+	plan := policy.plan(snaps)
 
-		m := re.FindStringSubmatch(sn)
-		if m == nil {
+	// Keep anything that the consumers of this volume still need.
+	holds := consumerHolds(v.Zfs, ds.Snaps, "")
+	for _, dec := range plan {
+		if len(holds[dec.Name]) == 0 {
 			continue
 		}
+		dec.pinned = true
+		if !dec.Keep {
+			dec.Keep = true
+			dec.Reasons = nil
+			for _, cons := range holds[dec.Name] {
+				dec.Reasons = append(dec.Reasons, "held by "+cons)
+			}
+		}
+	}
+
+	conv.applyMinimum(plan)
 
-		// Assume the date is of this form.
-		tm, err := time.Parse("200601021504", m[2])
+	space, err := v.applySpace(ds, conv, plan)
+	if err != nil {
+		return err
+	}
+
+	keeps, removes := splitPlan(plan)
+
+	if pruneJSON {
+		pruneReports = append(pruneReports, &pruneReport{
+			Volume:     v.Name,
+			Zfs:        v.Zfs,
+			Convention: conv.Name,
+			Policy:     policy.String(),
+			Snapshots:  plan,
+		})
+		return nil
+	}
+
+	fmt.Printf("Policy: %s\n", policy)
+	fmt.Printf("Keep %d, prune %d\n", len(keeps), len(removes))
+
+	if pruneExplain {
+		explainPlan(plan)
+	}
+
+	err = conv.checkFraction(v, len(removes), len(plan))
+	if err != nil {
+		return err
+	}
+
+	if pretend {
+		fmt.Printf("Would remove:\n")
+		for _, s := range removes {
+			fmt.Printf("    %s\n", s)
+		}
+	} else {
+		err = removeSnaps(ds, removes, v.Recursive)
 		if err != nil {
-			fmt.Printf("Invalid time: %q (%s)\n", m[2], err)
+			return err
+		}
+
+		if space != nil {
+			err = space.report()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// removeSnaps bookmarks, and then removes the given snapshots, in
+// batches.  Snapshots that can't be bookmarked are not removed.  The
+// snapshots that fail are reported individually.
+func removeSnaps(ds *zfs.DataSet, removes []string, recursive bool) error {
+	for _, s := range removes {
+		fmt.Printf("   Remove %s\n", s)
+	}
+
+	failed := make(zfs.BatchError)
+	if berr, ok := ds.BookmarkAll(removes).(zfs.BatchError); ok {
+		for name, err := range berr {
+			failed[name] = fmt.Errorf("bookmark: %s", err)
+		}
+	}
+
+	var ready []string
+	for _, s := range removes {
+		if failed[s] == nil {
+			ready = append(ready, s)
+		}
+	}
+
+	if berr, ok := ds.RemoveSnaps(ready, recursive).(zfs.BatchError); ok {
+		for name, err := range berr {
+			failed[name] = err
+		}
+	}
+
+	if len(failed) == 0 {
+		return nil
+	}
+
+	for _, s := range removes {
+		if failed[s] != nil {
+			fmt.Printf("   Failed %s: %s\n", s, failed[s])
+		}
+	}
+	return fmt.Errorf("Unable to remove %d of %d snapshots of %q",
+		len(failed), len(removes), ds.Name)
+}
+
+// A Retention describes which snapshots to keep.  Each count based
+// rule keeps the newest snapshot in each of that many of the most
+// recent buckets (hours, days, etc).  Each duration based rule keeps
+// the newest snapshot in every bucket within that duration of the
+// newest snapshot, with Within keeping every snapshot.  Durations are
+// measured from the newest snapshot, rather than the current time, so
+// that nothing is lost when the machine has been off for a while.  A
+// snapshot is kept if any rule keeps it.
+type Retention struct {
+	Last    int
+	Hourly  int
+	Daily   int
+	Weekly  int
+	Monthly int
+	Yearly  int
+
+	Within        time.Duration
+	WithinHourly  time.Duration
+	WithinDaily   time.Duration
+	WithinWeekly  time.Duration
+	WithinMonthly time.Duration
+	WithinYearly  time.Duration
+}
+
+// The default limit on the fraction of a volume's snapshots that a
+// single prune may remove without confirmation.
+const defaultMaxPrune = 0.5
+
+// applyMinimum changes the plan so that the newest snapshot, and at
+// least MinKeep snapshots are always kept, no matter what the
+// retention rules say.
+func (c *SnapConvention) applyMinimum(plan []*pruneDecision) {
+	kept := 0
+	for _, dec := range plan {
+		if dec.Keep {
+			kept++
+		}
+	}
+
+	if len(plan) > 0 {
+		plan[0].pinned = true
+	}
+
+	for i, dec := range plan {
+		if dec.Keep {
 			continue
 		}
+		if i == 0 {
+			dec.Reasons = []string{"newest snapshot"}
+		} else if kept < c.MinKeep {
+			dec.Reasons = []string{fmt.Sprintf("minimum keep %d", c.MinKeep)}
+		} else {
+			continue
+		}
+		dec.Keep = true
+		kept++
+	}
+}
 
-		// fmt.Printf("Time: %q, %s\n", sn, tm)
+// checkFraction makes sure that removing count of total snapshots is
+// within the convention's MaxPrune.  If it isn't, the removal has to
+// be forced, or confirmed interactively.
+func (c *SnapConvention) checkFraction(v *SnapVolume, count, total int) error {
+	limit := c.MaxPrune
+	if limit <= 0 {
+		limit = defaultMaxPrune
+	}
+
+	if count == 0 || float64(count) <= limit*float64(total) {
+		return nil
+	}
+
+	msg := fmt.Sprintf("Prune of %q would remove %d of %d snapshots, more than %g%%",
+		v.Zfs, count, total, limit*100)
+	if pruneForce {
+		fmt.Printf("%s, forced\n", msg)
+		return nil
+	}
+	if pretend {
+		fmt.Printf("%s, would need --force\n", msg)
+		return nil
+	}
+
+	if isTerminal(os.Stdin) {
+		fmt.Printf("%s.  Continue? [y/N] ", msg)
+		line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		answer := strings.ToLower(strings.TrimSpace(line))
+		if answer == "y" || answer == "yes" {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s, use --force to allow", msg)
+}
+
+// isTerminal returns true if the file is an interactive terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// A RetentionOverride changes individual rules of a convention's
+// Retention for a single volume.  Rules that aren't given are
+// inherited from the convention.
+type RetentionOverride struct {
+	Last    *int
+	Hourly  *int
+	Daily   *int
+	Weekly  *int
+	Monthly *int
+	Yearly  *int
+
+	Within        *time.Duration
+	WithinHourly  *time.Duration
+	WithinDaily   *time.Duration
+	WithinWeekly  *time.Duration
+	WithinMonthly *time.Duration
+	WithinYearly  *time.Duration
+}
+
+// override returns the retention with the given overrides applied.
+func (r Retention) override(o *RetentionOverride) Retention {
+	counts := []struct {
+		dest *int
+		src  *int
+	}{
+		{&r.Last, o.Last},
+		{&r.Hourly, o.Hourly},
+		{&r.Daily, o.Daily},
+		{&r.Weekly, o.Weekly},
+		{&r.Monthly, o.Monthly},
+		{&r.Yearly, o.Yearly},
+	}
+	for _, c := range counts {
+		if c.src != nil {
+			*c.dest = *c.src
+		}
+	}
+
+	withins := []struct {
+		dest *time.Duration
+		src  *time.Duration
+	}{
+		{&r.Within, o.Within},
+		{&r.WithinHourly, o.WithinHourly},
+		{&r.WithinDaily, o.WithinDaily},
+		{&r.WithinWeekly, o.WithinWeekly},
+		{&r.WithinMonthly, o.WithinMonthly},
+		{&r.WithinYearly, o.WithinYearly},
+	}
+	for _, w := range withins {
+		if w.src != nil {
+			*w.dest = *w.src
+		}
+	}
+
+	return r
+}
+
+// String describes the rules of the retention.
+func (r Retention) String() string {
+	var rules []string
+	counts := []struct {
+		name  string
+		count int
+	}{
+		{"last", r.Last},
+		{"hourly", r.Hourly},
+		{"daily", r.Daily},
+		{"weekly", r.Weekly},
+		{"monthly", r.Monthly},
+		{"yearly", r.Yearly},
+	}
+	for _, c := range counts {
+		if c.count > 0 {
+			rules = append(rules, fmt.Sprintf("%s %d", c.name, c.count))
+		}
+	}
+
+	withins := []struct {
+		name   string
+		within time.Duration
+	}{
+		{"within", r.Within},
+		{"within-hourly", r.WithinHourly},
+		{"within-daily", r.WithinDaily},
+		{"within-weekly", r.WithinWeekly},
+		{"within-monthly", r.WithinMonthly},
+		{"within-yearly", r.WithinYearly},
+	}
+	for _, w := range withins {
+		if w.within > 0 {
+			rules = append(rules, fmt.Sprintf("%s %s", w.name, w.within))
+		}
+	}
+
+	if len(rules) == 0 {
+		return "no rules"
+	}
+	return strings.Join(rules, ", ")
+}
+
+// A snapTime is a snapshot, along with the time it was taken.
+type snapTime struct {
+	Name string
+	Time time.Time
+}
+
+// A pruneDecision records whether a snapshot is kept, and the reasons
+// why.  For kept snapshots, the reasons are the buckets that caused it
+// to be kept, for removed ones, why each rule didn't keep it.
+type pruneDecision struct {
+	Name    string    `json:"name"`
+	Time    time.Time `json:"time"`
+	Keep    bool      `json:"keep"`
+	Reasons []string  `json:"reasons"`
+
+	// pinned snapshots must be kept, regardless of space.
+	pinned bool
+}
+
+// plan determines which snapshots are kept, and which removed.  The
+// snaps must be given newest first, and the decisions are returned in
+// the same order.
+func (r *Retention) plan(snaps []snapTime) []*pruneDecision {
+	var buckets = [6]struct {
+		Name   string
+		Total  int
+		bucker func(d time.Time, nr int) int
+		Count  int
+		Last   int
+	}{
+		{"last", r.Last, always, r.Last, -1},
+		{"hourly", r.Hourly, ymdh, r.Hourly, -1},
+		{"daily", r.Daily, ymd, r.Daily, -1},
+		{"weekly", r.Weekly, yw, r.Weekly, -1},
+		{"monthly", r.Monthly, ym, r.Monthly, -1},
+		{"yearly", r.Yearly, y, r.Yearly, -1},
+	}
+
+	var withins = [6]struct {
+		Name   string
+		Within time.Duration
+		bucker func(d time.Time, nr int) int
+		Last   int
+	}{
+		{"within", r.Within, always, -1},
+		{"within-hourly", r.WithinHourly, ymdh, -1},
+		{"within-daily", r.WithinDaily, ymd, -1},
+		{"within-weekly", r.WithinWeekly, yw, -1},
+		{"within-monthly", r.WithinMonthly, ym, -1},
+		{"within-yearly", r.WithinYearly, y, -1},
+	}
+
+	var newest time.Time
+	if len(snaps) > 0 {
+		newest = snaps[0].Time
+	}
+
+	var result []*pruneDecision
+	for nr, sn := range snaps {
+		var keeps, removes []string
 
 		// Update the buckets
 		for i, b := range buckets {
 			if b.Count > 0 {
-				val := b.bucker(tm, nr)
+				val := b.bucker(sn.Time, nr)
 				if val != b.Last {
-					keepSnap = true
+					if i == 0 {
+						// The "last" bucket is just a count.
+						keeps = append(keeps, fmt.Sprintf("last %d/%d",
+							b.Total-b.Count+1, b.Total))
+					} else {
+						keeps = append(keeps, fmt.Sprintf("%s %d", b.Name, val))
+					}
 					buckets[i].Last = val
 					buckets[i].Count--
+				} else {
+					removes = append(removes, fmt.Sprintf("%s %d has newer", b.Name, val))
 				}
+			} else if b.Total > 0 {
+				removes = append(removes, fmt.Sprintf("%s count %d reached", b.Name, b.Total))
 			}
 		}
 
-		if keepSnap {
-			keeps = append(keeps, sn)
-		} else {
-			removes = append(removes, sn)
+		for i, w := range withins {
+			if w.Within <= 0 {
+				continue
+			}
+			if sn.Time.Before(newest.Add(-w.Within)) {
+				removes = append(removes, fmt.Sprintf("%s %s expired", w.Name, w.Within))
+				continue
+			}
+			val := w.bucker(sn.Time, nr)
+			if val != w.Last {
+				keeps = append(keeps, fmt.Sprintf("%s %d", w.Name, val))
+				withins[i].Last = val
+			} else {
+				removes = append(removes, fmt.Sprintf("%s %d has newer", w.Name, val))
+			}
+		}
+
+		dec := &pruneDecision{
+			Name:    sn.Name,
+			Time:    sn.Time,
+			Keep:    len(keeps) > 0,
+			Reasons: keeps,
 		}
+		if !dec.Keep {
+			dec.Reasons = removes
+			if len(removes) == 0 {
+				dec.Reasons = []string{"no rules"}
+			}
+		}
+		result = append(result, dec)
 	}
 
-	reverseStrings(removes)
+	return result
+}
 
-	fmt.Printf("Keep %d, prune %d\n", len(keeps), len(removes))
+// retained returns which of the candidate snapshots this retention
+// would keep, if they were added to the existing ones.  Candidates
+// that would be removed at once don't need to be made: they are
+// usually ones that an earlier prune already removed.  Without any
+// rules, nothing is removed, and the newest of all is always kept.
+func (r *Retention) retained(existing, candidates []snapTime) map[string]bool {
+	kept := make(map[string]bool)
+	if *r == (Retention{}) {
+		for _, c := range candidates {
+			kept[c.Name] = true
+		}
+		return kept
+	}
 
-	if pretend {
-		fmt.Printf("Would remove:\n")
-		for _, s := range removes {
-			fmt.Printf("    %s\n", s)
+	type entry struct {
+		snapTime
+		candidate bool
+	}
+	var all []entry
+	for _, e := range existing {
+		all = append(all, entry{e, false})
+	}
+	for _, c := range candidates {
+		all = append(all, entry{c, true})
+	}
+	sort.SliceStable(all, func(i, j int) bool {
+		return all[i].Time.After(all[j].Time)
+	})
+
+	snaps := make([]snapTime, len(all))
+	for i := range all {
+		snaps[i] = all[i].snapTime
+	}
+
+	for i, dec := range r.plan(snaps) {
+		if all[i].candidate && (dec.Keep || i == 0) {
+			kept[dec.Name] = true
 		}
-	} else {
-		for _, s := range removes {
-			fmt.Printf("   Remove %s\n", s)
-			err = ds.Bookmark(s)
-			if err != nil {
-				return err
-			}
+	}
+	return kept
+}
 
-			err = ds.RemoveSnap(s)
-			if err != nil {
-				return err
-			}
+// splitPlan returns the names of the kept snapshots, newest first,
+// and the removed ones, oldest first.
+func splitPlan(plan []*pruneDecision) (keeps, removes []string) {
+	for _, dec := range plan {
+		if dec.Keep {
+			keeps = append(keeps, dec.Name)
+		} else {
+			removes = append(removes, dec.Name)
 		}
 	}
+	reverseStrings(removes)
+	return
+}
 
-	return nil
+// A pruneReport is the explanation of the prune of a single volume,
+// as written with --json.
+type pruneReport struct {
+	Volume     string           `json:"volume"`
+	Zfs        string           `json:"zfs"`
+	Convention string           `json:"convention"`
+	Policy     string           `json:"policy"`
+	Snapshots  []*pruneDecision `json:"snapshots"`
+}
+
+// pruneReports collects the report of each volume, to be written as a
+// single array with --json.
+var pruneReports = []*pruneReport{}
+
+// pruneLog returns where prune should write its progress messages.
+// With --json, this is stderr, so that only the report is written to
+// stdout.
+func pruneLog() io.Writer {
+	if pruneJSON {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// explainPlan writes a description of each decision in the plan.
+func explainPlan(plan []*pruneDecision) {
+	for _, dec := range plan {
+		action := "remove"
+		if dec.Keep {
+			action = "keep"
+		}
+		fmt.Printf("  %-6s %-30s %s\n", action, dec.Name, strings.Join(dec.Reasons, ", "))
+	}
 }
 
 // reverseStrings reverses a slice of strings.
@@ -177,7 +708,7 @@ func reverseStrings(ss []string) {
 // This is borrowed from Restic, hopefully resulting in the same
 // values.
 
-/// ymdh returns an integer in the form YYYYMMDDHH.
+// ymdh returns an integer in the form YYYYMMDDHH.
 func ymdh(d time.Time, _ int) int {
 	return d.Year()*1000000 + int(d.Month())*10000 + d.Day()*100 + d.Hour()
 }
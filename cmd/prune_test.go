@@ -0,0 +1,153 @@
+package cmd
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// hourlySnaps makes count snapshots, an hour apart, newest first,
+// with the newest at the given time.
+func hourlySnaps(newest time.Time, count int) []snapTime {
+	var snaps []snapTime
+	for i := 0; i < count; i++ {
+		tm := newest.Add(-time.Duration(i) * time.Hour)
+		snaps = append(snaps, snapTime{
+			Name: fmt.Sprintf("snap-%s", tm.Format("200601021504")),
+			Time: tm,
+		})
+	}
+	return snaps
+}
+
+func TestRetentionPlan(t *testing.T) {
+	newest := time.Date(2018, 7, 4, 12, 0, 0, 0, time.UTC)
+	snaps := hourlySnaps(newest, 24*10)
+
+	var tests = []struct {
+		ret   Retention
+		keeps int
+	}{
+		{Retention{}, 0},
+		{Retention{Last: 5}, 5},
+		{Retention{Hourly: 24}, 24},
+		{Retention{Daily: 3}, 3},
+		{Retention{Last: 5, Daily: 3}, 7},
+		{Retention{Within: 48 * time.Hour}, 49},
+		{Retention{WithinDaily: 72 * time.Hour}, 4},
+		{Retention{Within: 12 * time.Hour, WithinDaily: 30 * 24 * time.Hour}, 23},
+	}
+
+	for _, tt := range tests {
+		keeps, removes := splitPlan(tt.ret.plan(snaps))
+		if len(keeps) != tt.keeps || len(keeps)+len(removes) != len(snaps) {
+			t.Errorf("%+v: keep %d, remove %d, want keep %d",
+				tt.ret, len(keeps), len(removes), tt.keeps)
+		}
+		if len(keeps) > 0 && keeps[0] != snaps[0].Name {
+			t.Errorf("%+v: newest snapshot not kept", tt.ret)
+		}
+	}
+}
+
+// Durations are measured from the newest snapshot, so a gap in
+// snapshots doesn't cause the retained ones to be removed.
+func TestRetentionWithinGap(t *testing.T) {
+	newest := time.Date(2018, 7, 4, 12, 0, 0, 0, time.UTC)
+	snaps := hourlySnaps(newest, 3)
+
+	ret := Retention{Within: 48 * time.Hour}
+	keeps, removes := splitPlan(ret.plan(snaps))
+
+	want := []string{snaps[0].Name, snaps[1].Name, snaps[2].Name}
+	if !reflect.DeepEqual(keeps, want) || len(removes) != 0 {
+		t.Errorf("keeps %v, removes %v", keeps, removes)
+	}
+}
+
+func TestRetentionReasons(t *testing.T) {
+	newest := time.Date(2018, 7, 4, 12, 0, 0, 0, time.UTC)
+	snaps := hourlySnaps(newest, 14)
+
+	ret := Retention{Last: 1, Daily: 2}
+	plan := ret.plan(snaps)
+
+	want := map[string][]string{
+		snaps[0].Name:  {"last 1/1", "daily 20180704"},
+		snaps[1].Name:  {"last count 1 reached", "daily 20180704 has newer"},
+		snaps[13].Name: {"daily 20180703"},
+	}
+	for _, dec := range plan {
+		reasons, ok := want[dec.Name]
+		if ok && !reflect.DeepEqual(dec.Reasons, reasons) {
+			t.Errorf("%s: reasons %q, want %q", dec.Name, dec.Reasons, reasons)
+		}
+	}
+}
+
+// A convention with no rules must still keep the newest snapshots.
+func TestApplyMinimum(t *testing.T) {
+	newest := time.Date(2018, 7, 4, 12, 0, 0, 0, time.UTC)
+	snaps := hourlySnaps(newest, 10)
+
+	conv := SnapConvention{MinKeep: 3}
+	plan := conv.Retention.plan(snaps)
+	conv.applyMinimum(plan)
+
+	keeps, removes := splitPlan(plan)
+	want := []string{snaps[0].Name, snaps[1].Name, snaps[2].Name}
+	if !reflect.DeepEqual(keeps, want) || len(removes) != 7 {
+		t.Errorf("keeps %v, removes %v", keeps, removes)
+	}
+}
+
+func TestRetentionOverride(t *testing.T) {
+	conv := Retention{Hourly: 24, Daily: 7, Monthly: 12}
+	monthly := 36
+	daily := 0
+	within := 48 * time.Hour
+
+	got := conv.override(&RetentionOverride{
+		Monthly: &monthly,
+		Daily:   &daily,
+		Within:  &within,
+	})
+	want := Retention{Hourly: 24, Monthly: 36, Within: 48 * time.Hour}
+	if got != want {
+		t.Errorf("override: got %+v, want %+v", got, want)
+	}
+	if got.String() != "hourly 24, monthly 36, within 48h0m0s" {
+		t.Errorf("String: got %q", got.String())
+	}
+}
+
+// Snapshots that the retention would remove as soon as they were
+// backed up aren't wanted.
+func TestRetentionRetained(t *testing.T) {
+	newest := time.Date(2018, 7, 4, 12, 0, 0, 0, time.UTC)
+	snaps := hourlySnaps(newest, 48)
+
+	// Daily backups exist of the newest snapshot of each day.
+	existing := []snapTime{snaps[0], snaps[13]}
+	candidates := []snapTime{snaps[1], snaps[12], snaps[14], snaps[40]}
+
+	ret := Retention{Daily: 7}
+	kept := ret.retained(existing, candidates)
+	want := map[string]bool{snaps[40].Name: true}
+	if !reflect.DeepEqual(kept, want) {
+		t.Errorf("retained: got %v, want %v", kept, want)
+	}
+
+	// Without any rules, everything is wanted.
+	kept = (&Retention{}).retained(existing, candidates)
+	if len(kept) != len(candidates) {
+		t.Errorf("no rules: got %v", kept)
+	}
+
+	// The newest is always wanted.
+	kept = ret.retained(nil, []snapTime{snaps[0]})
+	if !kept[snaps[0].Name] {
+		t.Errorf("newest not retained")
+	}
+}
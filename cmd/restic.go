@@ -17,10 +17,11 @@ package cmd
 import (
 	"fmt"
 	"os"
-	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"davidb.org/x/gack/resticcmd"
-	"davidb.org/x/gack/zfs"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -38,6 +39,11 @@ config file.`,
 			fmt.Println(err)
 			os.Exit(1)
 		}
+		err = checkTools(false, true)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
 		fmt.Printf("pretend: %t\n", resticOptions.Pretend)
 		fmt.Printf("restic called: %v\n\n", &config)
 
@@ -54,11 +60,21 @@ config file.`,
 
 type ResticOptions struct {
 	Pretend bool
+	Limit   int
+	Order   string
 }
 
 var resticOptions ResticOptions
 
 type ResticConfig struct {
+	// Command is the restic program, found through PATH if not an
+	// absolute path.  Args are extra arguments given to every
+	// restic command, and Env ("NAME=value") adds to its
+	// environment.  These apply to all volumes.
+	Command string
+	Args    []string
+	Env     []string
+
 	Volumes []ResticVolume
 }
 
@@ -69,8 +85,37 @@ type ResticVolume struct {
 	Repo         string
 	Passwordfile string
 
+	// Retention gives which restic snapshots of this volume "prune
+	// --restic" keeps.  Without any rules, nothing is forgotten.
+	// Prune runs "restic prune" after forgetting snapshots.
+	Retention Retention
+	Prune     bool
+
+	// Limit, if non-zero, is the most snapshots of this volume
+	// backed up in one run.  Order is either "oldest" (the
+	// default), to back up the oldest snapshots first, or
+	// "newest".
+	Limit int
+	Order string
+
+	// Command overrides the global restic program for this
+	// volume.  Args and Env are added to the global ones.
+	Command string
+	Args    []string
+	Env     []string
+
 	repo  *resticcmd.Repo
-	mount string
+	snaps SnapProvider
+
+	// backedIDs maps the ZFS snapshots that have been backed up to
+	// their restic snapshot IDs.  backed holds the restic
+	// snapshots of this volume that Forget manages.
+	backedIDs map[string]string
+	backed    []snapTime
+
+	// legacyIDs are the restic snapshots of this volume made
+	// before the volume tag, which Forget tags before using.
+	legacyIDs []string
 }
 
 func init() {
@@ -78,6 +123,11 @@ func init() {
 
 	resticCmd.Flags().BoolVarP(&resticOptions.Pretend, "pretend", "n", false,
 		"show what would have been executed, but don't actually run")
+
+	resticCmd.Flags().IntVarP(&resticOptions.Limit, "limit", "l", 0,
+		"Limit the total number of backups to be run.")
+	resticCmd.Flags().StringVar(&resticOptions.Order, "order", "",
+		"back up the \"oldest\" or \"newest\" snapshots first, overriding the config")
 	// Here you will define your flags and configuration settings.
 
 	// Cobra supports Persistent Flags which will work for this command
@@ -92,84 +142,441 @@ func init() {
 // Sync attempts to catch up on any backups that need to be done
 // between snapshots and the restic volume.
 func (rv *ResticVolume) Sync() error {
-	path := zfs.ParsePath(rv.Zfs)
-	ds, err := zfs.GetSnaps(path)
+	var err error
+	rv.snaps, err = OpenSnapProvider(rv.Zfs)
 	if err != nil {
 		return err
 	}
+	zsnaps := rv.snaps.Snaps()
+
+	fmt.Printf("%d snapshots\n", len(zsnaps))
 
-	rv.mount, err = FindMount(rv.Zfs, "zfs")
+	// Collect the snapshots that need to be backed up, in the
+	// order they should be done.
+	todo, dropped, err := rv.toBackUp(zsnaps)
 	if err != nil {
 		return err
 	}
+	fmt.Printf("%d snapshots backed up in restic\n", len(rv.backed))
+	if dropped > 0 {
+		fmt.Printf("%d snapshots not backed up, as the retention would forget them\n",
+			dropped)
+	}
 
-	fmt.Printf("%d zfs volumes\n", len(ds))
-	fmt.Printf("%d zfs snapshots\n", len(ds[0].Snaps))
+	order := rv.Order
+	if resticOptions.Order != "" {
+		order = resticOptions.Order
+	}
+	switch order {
+	case "", "oldest":
+	case "newest":
+		reverseStrings(todo)
+	default:
+		return fmt.Errorf("Restic %q: unknown order %q", rv.Name, order)
+	}
 
-	// Get information on backups we've done.
-	rv.repo = &resticcmd.Repo{
-		Path:         rv.Repo,
-		Passwordfile: rv.Passwordfile,
+	if rv.Limit > 0 && len(todo) > rv.Limit {
+		todo = todo[:rv.Limit]
+	}
+
+	fmt.Printf("%d snapshots to sync to restic\n", len(todo))
+
+	var total backupStats
+	for i, snap := range todo {
+		fmt.Printf("-----------------------------------\n")
+		fmt.Printf("Backing restic %d of %d\n", i+1, len(todo))
+		parent := rv.parentOf(zsnaps, snap)
+		if !resticOptions.Pretend {
+			stats, err := rv.SyncSingle(snap, parent)
+			if err != nil {
+				return err
+			}
+			total.add(stats)
+		} else {
+			fmt.Printf("Would back up %q:%q to %q\n", rv.Zfs, snap, rv.Repo)
+			fmt.Printf("    tags: %s\n", strings.Join(rv.tags(snap), ", "))
+			if parent != "" {
+				fmt.Printf("    parent: %s\n", parent)
+			}
+		}
+
+		// Check the global limit.  Note that we will always
+		// do at least one from each volume.
+		resticCount++
+		if resticOptions.Limit > 0 && resticCount >= resticOptions.Limit {
+			fmt.Printf("Reached limit, stopping\n")
+			break
+		}
+	}
+
+	if total.Backups > 1 {
+		fmt.Printf("Total of %d backups: %s\n", total.Backups, &total)
+	}
+
+	return nil
+}
+
+var resticCount = 0
+
+// BackedSnaps queries the restic repository, and returns the set of
+// snapshots of this volume that have been backed up.
+func (rv *ResticVolume) BackedSnaps() (map[string]bool, error) {
+	err := rv.openRepo()
+	if err != nil {
+		return nil, err
 	}
 
 	snaps, err := rv.repo.GetSnapshots()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	fmt.Printf("%d restic snapshots\n", len(snaps))
 
-	// Collect all of the tags that have been snapped (where the
-	// backup volume matches the Bind).
+	return rv.setBacked(snaps), nil
+}
+
+// setBacked records which of the restic snapshots belong to this
+// volume, returning the set of ZFS snapshots they back up.  Only these
+// are used as parents, since another volume sharing the bind path may
+// have backed up a snapshot of the same name.
+func (rv *ResticVolume) setBacked(snaps []*resticcmd.Snapshot) map[string]bool {
+	// Collect the tags of this volume's snapshots, and remember
+	// the restic snapshot of each, to use as parents.  Restic
+	// lists the snapshots oldest first, so the newest backup of a
+	// snapshot wins.
+	var legacy bool
+	snaps, legacy = volumeSnapshots(snaps, rv.Bind, rv.volumeTag())
 	backedSnaps := make(map[string]bool)
+	rv.backedIDs = make(map[string]string)
+	rv.backed = nil
+	rv.legacyIDs = nil
 	for _, snap := range snaps {
-		if snap.HasPath(rv.Bind) {
-			for _, t := range snap.Tags {
+		if snap.ID == "" {
+			continue
+		}
+		for _, t := range snap.Tags {
+			if !strings.HasPrefix(t, volumeTagPrefix) {
 				backedSnaps[t] = true
+				rv.backedIDs[t] = snap.ID
 			}
 		}
+		rv.backed = append(rv.backed, snapTime{Name: snap.ID, Time: snap.Time})
+		if legacy {
+			rv.legacyIDs = append(rv.legacyIDs, snap.ID)
+		}
 	}
 
-	// Go through each ZFS snapshot and determine if it needs to
-	// be backed up.
-	// TODO: Handle child volumes better.
-	for _, snap := range ds[0].Snaps {
-		if backedSnaps[snap] {
+	return backedSnaps
+}
+
+// volumeSnapshots returns the restic snapshots of the volume with the
+// given bind path and volume tag.  Backups made before the volume tag
+// was added have no volume tag at all.  These are returned (with
+// legacy true) only if there are no tagged snapshots, as until then
+// they are the only record of what has been backed up.
+func volumeSnapshots(snaps []*resticcmd.Snapshot, bind, tag string) ([]*resticcmd.Snapshot, bool) {
+	var tagged, untagged []*resticcmd.Snapshot
+	for _, snap := range snaps {
+		if !snap.HasPath(bind) {
 			continue
 		}
-		if !resticOptions.Pretend {
-			err = rv.SyncSingle(snap)
-			if err != nil {
-				return err
+		if snap.HasTag(tag) {
+			tagged = append(tagged, snap)
+			continue
+		}
+
+		other := false
+		for _, t := range snap.Tags {
+			if strings.HasPrefix(t, volumeTagPrefix) {
+				other = true
 			}
 		}
+		if !other {
+			untagged = append(untagged, snap)
+		}
+	}
+
+	if len(tagged) > 0 {
+		return tagged, false
+	}
+	return untagged, len(untagged) > 0
+}
+
+// toBackUp returns the snapshots, out of zsnaps (oldest first), that
+// need to be backed up, and the number left out because of the
+// volume's retention.  See pendingBackups.
+func (rv *ResticVolume) toBackUp(zsnaps []string) ([]string, int, error) {
+	backedSnaps, err := rv.BackedSnaps()
+	if err != nil {
+		return nil, 0, err
+	}
+	if rv.snaps == nil {
+		rv.snaps, err = OpenSnapProvider(rv.Zfs)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	times, err := rv.snaps.Times()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	todo, dropped := pendingBackups(zsnaps, times, backedSnaps, rv.backed, &rv.Retention)
+	return todo, dropped, nil
+}
 
-		// Limit number run each time.
-		// break
+// openRepo sets up the restic repository of this volume, combining
+// the global settings with the volume's, and checks that the restic
+// program is recent enough.
+func (rv *ResticVolume) openRepo() error {
+	global := &GackConfig.Restic
+
+	repo := &resticcmd.Repo{
+		Path:         rv.Repo,
+		Passwordfile: rv.Passwordfile,
+		Command:      global.Command,
+	}
+	if rv.Command != "" {
+		repo.Command = rv.Command
 	}
+	repo.Args = append(append(repo.Args, global.Args...), rv.Args...)
+	repo.Env = append(append(repo.Env, global.Env...), rv.Env...)
 
+	if repo.Command == "" {
+		repo.Command = "restic"
+	}
+	err := checkVersion(repo.Command, resticcmd.MinVersion, repo.Version)
+	if err != nil {
+		return err
+	}
+
+	rv.repo = repo
 	return nil
 }
 
-// SyncSingle synchronizes a single backup.
-func (rv *ResticVolume) SyncSingle(snap string) error {
+// parentOf returns the restic snapshot of the nearest older ZFS
+// snapshot that has been backed up, or "" if there is none.  Using
+// this as the parent means restic only needs to read files that
+// changed between the two snapshots.
+func (rv *ResticVolume) parentOf(zsnaps []string, snap string) string {
+	parent := ""
+	for _, zs := range zsnaps {
+		if zs == snap {
+			break
+		}
+		if id, ok := rv.backedIDs[zs]; ok {
+			parent = id
+		}
+	}
+	return parent
+}
+
+// SyncSingle synchronizes a single backup, returning the statistics
+// of the backup.  If parent is not empty, it is the restic snapshot
+// to compare against.
+func (rv *ResticVolume) SyncSingle(snap, parent string) (*backupStats, error) {
 	fmt.Printf("Back up %q:%q to %q\n", rv.Zfs, snap, rv.Repo)
 
-	stat := filepath.Join(rv.mount, ".zfs", "snapshot", snap)
+	sn, err := rv.snaps.Materialize(snap, rv.Bind)
+	if err != nil {
+		return nil, err
+	}
+	defer sn.Release()
+
+	progress := newProgressLine()
+	rstats, err := rv.repo.RunBackup(sn.Dir, &resticcmd.BackupOptions{
+		Tags:   rv.tags(snap),
+		Time:   sn.Time,
+		Parent: parent,
+	}, progress.restic)
+	progress.done()
+	if err != nil {
+		return nil, err
+	}
+
+	// Later backups can use this one as their parent.
+	if rv.backedIDs == nil {
+		rv.backedIDs = make(map[string]string)
+	}
+	if rstats.SnapshotID != "" {
+		rv.backedIDs[snap] = rstats.SnapshotID
+	}
+
+	stats := resticStats(rstats)
+	fmt.Printf("Backed up %s\n", stats)
+	return stats, nil
+}
+
+// tags returns the restic tags given to the backup of a snapshot.
+func (rv *ResticVolume) tags(snap string) []string {
+	return []string{snap, rv.volumeTag()}
+}
+
+// volumeTag returns the restic tag that marks backups of this volume.
+// Since the Bind directory can be shared between volumes, this is
+// what identifies this volume's snapshots to forget.
+func (rv *ResticVolume) volumeTag() string {
+	return volumeTagPrefix + rv.Name
+}
+
+const volumeTagPrefix = "gack-volume="
+
+// sharesBind returns true if another restic volume backs up to the
+// same repository with the same bind path, so that snapshots without
+// a volume tag can't be told apart.
+func (rv *ResticVolume) sharesBind() bool {
+	for i := range GackConfig.Restic.Volumes {
+		other := &GackConfig.Restic.Volumes[i]
+		if other.Name != rv.Name && other.Repo == rv.Repo && other.Bind == rv.Bind {
+			return true
+		}
+	}
+	return false
+}
+
+// tagLegacy adds the volume tag to the snapshots of this volume made
+// before volume tags, so that Forget will manage them.  This is only
+// done if no other volume shares the bind path, as otherwise there is
+// no telling whose snapshots they are.
+func (rv *ResticVolume) tagLegacy() error {
+	_, err := rv.BackedSnaps()
+	if err != nil {
+		return err
+	}
+	if len(rv.legacyIDs) == 0 {
+		return nil
+	}
+
+	if rv.sharesBind() {
+		fmt.Printf("Restic %q: %d snapshots of %s without a volume tag are shared with other volumes, not forgetting them\n",
+			rv.Name, len(rv.legacyIDs), rv.Bind)
+		return nil
+	}
+
+	if pretend {
+		fmt.Printf("Would tag %d older snapshots with %s, which are not included below\n",
+			len(rv.legacyIDs), rv.volumeTag())
+		return nil
+	}
+
+	fmt.Printf("Tag %d older snapshots with %s\n", len(rv.legacyIDs), rv.volumeTag())
+	return rv.repo.Tag(rv.volumeTag(), rv.legacyIDs)
+}
+
+// Forget applies the volume's retention to its snapshots in the
+// restic repository.  The snapshots are selected by the volume tag
+// and bind path, and grouped by path; older snapshots without the tag
+// are tagged first (see tagLegacy).  In pretend mode, this shows
+// which snapshots would be forgotten.
+func (rv *ResticVolume) Forget() error {
+	args, err := forgetArgs(&rv.Retention)
+	if err != nil {
+		return fmt.Errorf("Restic %q: %s", rv.Name, err)
+	}
+	if len(args) == 0 {
+		return nil
+	}
+
+	err = rv.openRepo()
+	if err != nil {
+		return err
+	}
+
+	// The bucketed duration rules are newer than the rest.
+	r := &rv.Retention
+	if r.WithinHourly > 0 || r.WithinDaily > 0 || r.WithinWeekly > 0 ||
+		r.WithinMonthly > 0 || r.WithinYearly > 0 {
+		err = checkVersion(rv.repo.Command, resticWithinVersion, rv.repo.Version)
+		if err != nil {
+			return fmt.Errorf("Restic %q: within-hourly and similar rules: %s",
+				rv.Name, err)
+		}
+	}
 
-	// It is important to stat within the snapshot so that the ZFS
-	// automounter will mount it.  We can't use filepath.Join,
-	// because it will ignore the addition of the ".".
-	_, err := os.Lstat(stat + "/.")
+	err = rv.tagLegacy()
 	if err != nil {
 		return err
 	}
 
-	// Bind the mount to the desired Bind directory.
-	mount, err := NewBindMount(stat, rv.Bind)
+	args = append(args, "--tag", rv.volumeTag(), "--path", rv.Bind,
+		"--group-by", "paths")
+
+	fmt.Printf("Restic %q policy: %s\n", rv.Name, rv.Retention)
+	groups, err := rv.repo.Forget(args, pretend)
 	if err != nil {
 		return err
 	}
-	defer mount.Close()
 
-	return rv.repo.RunBackup(rv.Bind, []string{snap})
+	verb := "Forgot"
+	if pretend {
+		verb = "Would forget"
+	}
+
+	removed := 0
+	for _, group := range groups {
+		fmt.Printf("Keep %d, forget %d of %v\n", len(group.Keep), len(group.Remove),
+			group.Paths)
+		for _, snap := range group.Remove {
+			fmt.Printf("    %s %s %s %v\n", verb, snap.ID,
+				snap.Time.Format("2006-01-02 15:04:05"), snap.Tags)
+		}
+		removed += len(group.Remove)
+	}
+
+	if rv.Prune && removed > 0 && !pretend {
+		fmt.Printf("Prune %s\n", rv.Repo)
+		return rv.repo.Prune()
+	}
+
+	return nil
+}
+
+// resticWithinVersion is the first version of restic with
+// --keep-within-hourly and the like.
+const resticWithinVersion = "0.13.0"
+
+// forgetArgs returns the arguments to "restic forget" for the given
+// retention.  Restic durations are only given down to hours, so
+// shorter ones are rejected.
+func forgetArgs(r *Retention) ([]string, error) {
+	var args []string
+
+	counts := []struct {
+		flag  string
+		count int
+	}{
+		{"--keep-last", r.Last},
+		{"--keep-hourly", r.Hourly},
+		{"--keep-daily", r.Daily},
+		{"--keep-weekly", r.Weekly},
+		{"--keep-monthly", r.Monthly},
+		{"--keep-yearly", r.Yearly},
+	}
+	for _, c := range counts {
+		if c.count > 0 {
+			args = append(args, c.flag, strconv.Itoa(c.count))
+		}
+	}
+
+	withins := []struct {
+		flag   string
+		within time.Duration
+	}{
+		{"--keep-within", r.Within},
+		{"--keep-within-hourly", r.WithinHourly},
+		{"--keep-within-daily", r.WithinDaily},
+		{"--keep-within-weekly", r.WithinWeekly},
+		{"--keep-within-monthly", r.WithinMonthly},
+		{"--keep-within-yearly", r.WithinYearly},
+	}
+	for _, w := range withins {
+		if w.within > 0 {
+			if w.within < time.Hour {
+				return nil, fmt.Errorf("%s %s is less than an hour", w.flag, w.within)
+			}
+			hours := int(w.within / time.Hour)
+			args = append(args, w.flag, fmt.Sprintf("%dd%dh", hours/24, hours%24))
+		}
+	}
+
+	return args, nil
 }
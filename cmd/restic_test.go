@@ -0,0 +1,98 @@
+package cmd
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"davidb.org/x/gack/resticcmd"
+)
+
+func TestForgetArgs(t *testing.T) {
+	args, err := forgetArgs(&Retention{
+		Daily:       7,
+		WithinDaily: 50 * time.Hour,
+	})
+	want := []string{"--keep-daily", "7", "--keep-within-daily", "2d2h"}
+	if err != nil || !reflect.DeepEqual(args, want) {
+		t.Errorf("forgetArgs: got %q, %v, want %q", args, err, want)
+	}
+
+	_, err = forgetArgs(&Retention{Within: 30 * time.Minute})
+	if err == nil {
+		t.Errorf("forgetArgs accepted a duration under an hour")
+	}
+}
+
+func TestVolumeSnapshots(t *testing.T) {
+	snap := func(id, path string, tags ...string) *resticcmd.Snapshot {
+		return &resticcmd.Snapshot{ID: id, Paths: []string{path}, Tags: tags}
+	}
+	ids := func(snaps []*resticcmd.Snapshot) []string {
+		var result []string
+		for _, sn := range snaps {
+			result = append(result, sn.ID)
+		}
+		return result
+	}
+
+	legacy := []*resticcmd.Snapshot{
+		snap("a", "/bind", "hourly-201807041830"),
+		snap("b", "/bind", "hourly-201807041930", "gack-volume=other"),
+		snap("c", "/elsewhere", "hourly-201807042030"),
+	}
+	got, isLegacy := volumeSnapshots(legacy, "/bind", "gack-volume=home")
+	if !reflect.DeepEqual(ids(got), []string{"a"}) || !isLegacy {
+		t.Errorf("legacy: got %v, %t", ids(got), isLegacy)
+	}
+
+	// Once tagged snapshots exist, only they count.
+	tagged := append(legacy, snap("d", "/bind", "hourly-201807042130", "gack-volume=home"))
+	got, isLegacy = volumeSnapshots(tagged, "/bind", "gack-volume=home")
+	if !reflect.DeepEqual(ids(got), []string{"d"}) || isLegacy {
+		t.Errorf("tagged: got %v, %t", ids(got), isLegacy)
+	}
+
+	got, isLegacy = volumeSnapshots(nil, "/bind", "gack-volume=home")
+	if len(got) != 0 || isLegacy {
+		t.Errorf("empty: got %v, %t", ids(got), isLegacy)
+	}
+}
+
+func TestParentOf(t *testing.T) {
+	snap := func(id string, tags ...string) *resticcmd.Snapshot {
+		return &resticcmd.Snapshot{ID: id, Paths: []string{"/bind"}, Tags: tags}
+	}
+
+	// Another volume sharing the bind path has a newer backup of
+	// a snapshot with the same name, which must not be used.
+	rv := &ResticVolume{Name: "home", Bind: "/bind"}
+	backed := rv.setBacked([]*resticcmd.Snapshot{
+		snap("a1", "hourly-1", "gack-volume=home"),
+		snap("b1", "hourly-2", "gack-volume=other"),
+		snap("a2", "hourly-2", "gack-volume=home"),
+		snap("b2", "hourly-3", "gack-volume=other"),
+		snap("", "hourly-4", "gack-volume=home"),
+	})
+
+	want := map[string]bool{"hourly-1": true, "hourly-2": true}
+	if !reflect.DeepEqual(backed, want) {
+		t.Errorf("setBacked: got %v, want %v", backed, want)
+	}
+
+	zsnaps := []string{"hourly-1", "hourly-2", "hourly-3", "hourly-4", "hourly-5"}
+	var tests = []struct {
+		snap   string
+		parent string
+	}{
+		{"hourly-1", ""},
+		{"hourly-2", "a1"},
+		{"hourly-3", "a2"},
+		{"hourly-5", "a2"},
+	}
+	for _, tt := range tests {
+		if got := rv.parentOf(zsnaps, tt.snap); got != tt.parent {
+			t.Errorf("parentOf(%q): got %q, want %q", tt.snap, got, tt.parent)
+		}
+	}
+}
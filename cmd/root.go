@@ -63,6 +63,7 @@ type Config struct {
 	Restic ResticConfig
 	Clone  CloneConfig
 	Borg   BorgConfig
+	Check  CheckConfig
 }
 
 var GackConfig Config
@@ -89,7 +90,7 @@ func initConfig() {
 
 	// If a config file is found, read it in.
 	if err := viper.ReadInConfig(); err == nil {
-		fmt.Println("Using config file:", viper.ConfigFileUsed())
+		fmt.Fprintln(os.Stderr, "Using config file:", viper.ConfigFileUsed())
 	}
 
 	if err := viper.Unmarshal(&GackConfig); err != nil {
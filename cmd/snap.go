@@ -16,7 +16,10 @@ package cmd
 
 import (
 	"fmt"
+	"math"
 	"os"
+	"regexp"
+	"strconv"
 	"time"
 
 	"davidb.org/x/gack/zfs"
@@ -32,9 +35,32 @@ var snapCmd = &cobra.Command{
 		// Make sure snapshots all have same time.
 		now := time.Now()
 
+		var vols []*SnapVolume
+		var convs []*SnapConvention
 		snapPruneCmd(func(vol *SnapVolume, conv *SnapConvention) error {
-			return vol.Snap(now)
+			vols = append(vols, vol)
+			convs = append(convs, conv)
+			return nil
 		})
+		groups := groupVolumes(vols, convs)
+
+		// Check every group before taking any snapshots, so
+		// that a bad group doesn't leave the others half done.
+		for _, group := range groups {
+			err := group.validate()
+			if err != nil {
+				fmt.Printf("Error: %s\n", err)
+				os.Exit(1)
+			}
+		}
+
+		for _, group := range groups {
+			err := group.Snap(now)
+			if err != nil {
+				fmt.Printf("Error: %s\n", err)
+				os.Exit(1)
+			}
+		}
 	},
 }
 
@@ -47,7 +73,13 @@ func snapPruneCmd(action func(vol *SnapVolume, conv *SnapConvention) error) {
 
 	allConvs := make(map[string]*SnapConvention)
 	for j := range config.Conventions {
-		allConvs[config.Conventions[j].Name] = &config.Conventions[j]
+		conv := &config.Conventions[j]
+		err := conv.setup()
+		if err != nil {
+			fmt.Printf("Error: %s\n", err)
+			os.Exit(1)
+		}
+		allConvs[conv.Name] = conv
 	}
 
 	for i := range config.Volumes {
@@ -55,8 +87,8 @@ func snapPruneCmd(action func(vol *SnapVolume, conv *SnapConvention) error) {
 		// Find the convention.
 		conv, ok := allConvs[vol.Convention]
 		if !ok {
-			fmt.Printf("Snap %q has unknown convention %q\n", vol.Name, vol.Convention)
-			fmt.Printf("Skipping\n")
+			fmt.Fprintf(pruneLog(), "Snap %q has unknown convention %q\n", vol.Name, vol.Convention)
+			fmt.Fprintf(pruneLog(), "Skipping\n")
 			continue
 		}
 
@@ -71,22 +103,124 @@ func snapPruneCmd(action func(vol *SnapVolume, conv *SnapConvention) error) {
 type SnapConfig struct {
 	Conventions []SnapConvention
 	Volumes     []SnapVolume
+	Pools       []SnapPool
 }
 
 type SnapConvention struct {
-	Name    string
-	Last    int
-	Hourly  int
-	Daily   int
-	Weekly  int
-	Monthly int
-	Yearly  int
+	Name string
+
+	// The retention rules for snapshots of this convention,
+	// given directly in the convention.
+	Retention `mapstructure:",squash"`
+
+	// Safety limits on prune.  At least MinKeep snapshots (and
+	// always the newest) are kept, and removing more than MaxPrune
+	// (a fraction, defaulting to defaultMaxPrune) of the snapshots
+	// in one run requires --force or confirmation.
+	MinKeep  int
+	MaxPrune float64
+
+	// BookmarkWithin keeps the bookmarks of pruned snapshots for
+	// this long.  Older bookmarks are removed by "prune
+	// --bookmarks", unless needed by a clone.
+	BookmarkWithin time.Duration
+
+	// Hooks run around the snapshot of every volume using this
+	// convention.
+	Hooks SnapHooks
+
+	// SkipEmpty avoids taking a snapshot when less than
+	// MinWritten bytes (or nothing at all, if MinWritten is zero)
+	// have been written since the last snapshot of this
+	// convention.  A snapshot is still taken if it would be the
+	// first one in a daily, weekly, monthly or yearly bucket
+	// retained by this convention, by count or by a Within rule.
+	SkipEmpty  bool
+	MinWritten int64
+
+	// The naming of the snapshots.  See naming.go for a
+	// description of these.
+	Template string
+	Layout   string
+	Zone     string
+	Label    string
+
+	// Adopt lists formats of snapshots made by other tools that
+	// prune should manage as if they were made by this convention.
+	Adopt []string
+
+	adopts   []adoptFormat
+	loc      *time.Location
+	re       *regexp.Regexp
+	legacyRe *regexp.Regexp
 }
 
 type SnapVolume struct {
 	Name       string
 	Convention string
 	Zfs        string
+
+	// Hooks run around the snapshot of this volume, inside of the
+	// convention's hooks.
+	Hooks SnapHooks
+
+	// Recursive snapshots all descendent filesystems along with
+	// this one, atomically.
+	Recursive bool
+
+	// Retention overrides individual rules of the convention's
+	// retention for this volume.
+	Retention RetentionOverride
+
+	// Group names a set of volumes that are snapshotted together
+	// with a single atomic command.  All volumes in a group must be
+	// in the same pool, and agree on Recursive.
+	Group string
+}
+
+// A SnapGroup is a set of volumes that are snapshotted atomically.
+type SnapGroup struct {
+	Name  string
+	Vols  []*SnapVolume
+	Convs []*SnapConvention
+}
+
+// groupVolumes collects the volumes (along with their conventions)
+// into groups, in the order they appear in the config.  Volumes
+// without a group are snapshotted on their own.
+func groupVolumes(vols []*SnapVolume, convs []*SnapConvention) []*SnapGroup {
+	var groups []*SnapGroup
+	byName := make(map[string]*SnapGroup)
+	for i, vol := range vols {
+		group := byName[vol.Group]
+		if group == nil {
+			group = &SnapGroup{Name: vol.Group}
+			groups = append(groups, group)
+			if vol.Group != "" {
+				byName[vol.Group] = group
+			}
+		}
+		group.Vols = append(group.Vols, vol)
+		group.Convs = append(group.Convs, convs[i])
+	}
+	return groups
+}
+
+// validate checks that the volumes of the group can be snapshotted
+// with a single command: they must all be in the same pool, and agree
+// on Recursive.
+func (g *SnapGroup) validate() error {
+	path := zfs.ParsePath(g.Vols[0].Zfs)
+	for _, v := range g.Vols[1:] {
+		if !zfs.SamePool(path, zfs.ParsePath(v.Zfs)) {
+			return fmt.Errorf("Snap group %q: %q is not in the same pool as %q",
+				g.Name, v.Zfs, g.Vols[0].Zfs)
+		}
+		if v.Recursive != g.Vols[0].Recursive {
+			return fmt.Errorf("Snap group %q: volumes disagree on recursive", g.Name)
+		}
+	}
+	return nil
 }
 
 func init() {
@@ -95,21 +229,201 @@ func init() {
 		"show what would have been executed, but don't actually run")
 }
 
-func (v *SnapVolume) Snap(now time.Time) error {
-	name := fmt.Sprintf("%s-%s", v.Convention,
-		now.UTC().Format("200601021504"))
-	fmt.Printf("Snapshot %s@%s\n", v.Zfs, name)
+// Snap takes a snapshot of this volume, running any hooks given by
+// the volume or its convention.  The post-snap hooks are always run,
+// even if the snapshot fails.
+func (v *SnapVolume) Snap(conv *SnapConvention, now time.Time) error {
+	group := SnapGroup{
+		Vols:  []*SnapVolume{v},
+		Convs: []*SnapConvention{conv},
+	}
+	return group.Snap(now)
+}
+
+// Snap takes a snapshot of every volume in the group with a single
+// zfs command.  The pre-snap hooks of all volumes are run before, and
+// the post-snap hooks after, even if the snapshot fails.
+func (g *SnapGroup) Snap(now time.Time) (err error) {
+	err = g.validate()
+	if err != nil {
+		return err
+	}
+	path := zfs.ParsePath(g.Vols[0].Zfs)
+	recursive := g.Vols[0].Recursive
+
+	var names []string
+	var hooks []*hookRunner
+	for i, v := range g.Vols {
+		vpath := zfs.ParsePath(v.Zfs)
+		skip, err := v.skipEmpty(g.Convs[i], now)
+		if err != nil {
+			return err
+		}
+		if skip {
+			fmt.Printf("Skip unchanged %s\n", v.Zfs)
+			continue
+		}
+
+		name := g.Convs[i].snapName(now)
+		names = append(names, vpath.Name()+"@"+name)
+		hooks = append(hooks, &hookRunner{
+			vol:  v,
+			conv: g.Convs[i],
+			snap: name,
+		})
+	}
+
+	if len(names) == 0 {
+		return nil
+	}
+
+	// Post hooks are run for every volume whose pre hooks were
+	// started, in reverse order.
+	started := 0
+	defer func() {
+		for i := started - 1; i >= 0; i-- {
+			perr := hooks[i].post()
+			if err == nil {
+				err = perr
+			} else if perr != nil {
+				fmt.Printf("Error: %s\n", perr)
+			}
+		}
+	}()
+	failure := func(cause error) {
+		for i := 0; i < started; i++ {
+			hooks[i].failure(cause)
+		}
+	}
+
+	for _, h := range hooks {
+		started++
+		err = h.pre()
+		if err != nil {
+			failure(err)
+			return err
+		}
+	}
+
+	for _, h := range hooks {
+		fmt.Printf("Snapshot %s@%s\n", h.vol.Zfs, h.snap)
+	}
 
 	if pretend {
 		return nil
 	}
 
-	path := zfs.ParsePath(v.Zfs)
-	dss, err := zfs.GetSnaps(path)
+	err = zfs.Snapshot(path, recursive, names...)
 	if err != nil {
-		return err
+		failure(err)
+	}
+	return err
+}
+
+// skipEmpty determines if the snapshot of this volume at the given
+// time can be skipped, because the convention asks for empty
+// snapshots to be skipped, and not enough has been written since the
+// previous snapshot (to this volume, or for recursive volumes, to any
+// of its descendents).
+func (v *SnapVolume) skipEmpty(conv *SnapConvention, now time.Time) (bool, error) {
+	if !conv.SkipEmpty {
+		return false, nil
+	}
+
+	dss, err := zfs.GetSnaps(zfs.ParsePath(v.Zfs))
+	if err != nil {
+		return false, err
 	}
 	ds := dss[0]
 
-	return ds.AddSnap(name)
+	// Find the most recent snapshot of this convention.  Without
+	// one, there is nothing to compare against.
+	var last string
+	var lastTime time.Time
+	for i := len(ds.Snaps) - 1; i >= 0; i-- {
+		if tm, ok := conv.parseSnap(ds.Snaps[i]); ok {
+			last = ds.Snaps[i]
+			lastTime = tm
+			break
+		}
+	}
+	if last == "" {
+		return false, nil
+	}
+
+	// Never skip the first snapshot of a bucket that will be
+	// retained.
+	policy := conv.Retention.override(&v.Retention)
+	if policy.startsBucket(lastTime, now.In(conv.loc)) {
+		return false, nil
+	}
+
+	written, err := v.written(ds, last)
+	if err != nil {
+		return false, err
+	}
+
+	limit := conv.MinWritten
+	if limit < 1 {
+		limit = 1
+	}
+	return written < limit, nil
+}
+
+// startsBucket returns true if a snapshot at now would be the first
+// in a daily, weekly, monthly or yearly bucket that this retention
+// keeps, either by count or by a Within rule, given that the previous
+// snapshot was taken at last.
+func (r Retention) startsBucket(last, now time.Time) bool {
+	var buckets = []struct {
+		Count  int
+		Within time.Duration
+		bucker func(d time.Time, nr int) int
+	}{
+		{r.Daily, r.WithinDaily, ymd},
+		{r.Weekly, r.WithinWeekly, yw},
+		{r.Monthly, r.WithinMonthly, ym},
+		{r.Yearly, r.WithinYearly, y},
+	}
+	for _, b := range buckets {
+		if b.Count <= 0 && b.Within <= 0 {
+			continue
+		}
+		if b.bucker(last, 0) != b.bucker(now, 0) {
+			return true
+		}
+	}
+	return false
+}
+
+// written returns the number of bytes written to the volume since the
+// given snapshot.  For recursive volumes, this includes what was
+// written to all of the descendent filesystems.
+func (v *SnapVolume) written(ds *zfs.DataSet, snap string) (int64, error) {
+	if !v.Recursive {
+		text, err := ds.GetProp("written@" + snap)
+		if err != nil {
+			return 0, err
+		}
+		return strconv.ParseInt(text, 10, 64)
+	}
+
+	values, err := ds.GetPropTree("written@" + snap)
+	if err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for name, text := range values {
+		n, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			// A descendent without this snapshot (such
+			// as one created since) has no value, so
+			// treat it as having been written.
+			fmt.Printf("No written@%s for %s, not skipping\n", snap, name)
+			return math.MaxInt64, nil
+		}
+		total += n
+	}
+	return total, nil
 }
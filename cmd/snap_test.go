@@ -0,0 +1,176 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGroupVolumes(t *testing.T) {
+	conv := &SnapConvention{Name: "hourly"}
+	vols := []*SnapVolume{
+		{Name: "a", Zfs: "tank/a", Group: "tank"},
+		{Name: "b", Zfs: "tank/b"},
+		{Name: "c", Zfs: "tank/c", Group: "tank"},
+		{Name: "d", Zfs: "tank/d"},
+	}
+	convs := []*SnapConvention{conv, conv, conv, conv}
+
+	var names [][]string
+	for _, g := range groupVolumes(vols, convs) {
+		var gnames []string
+		for i, v := range g.Vols {
+			if g.Convs[i] != conv {
+				t.Errorf("group %q: wrong convention for %q", g.Name, v.Name)
+			}
+			gnames = append(gnames, v.Name)
+		}
+		names = append(names, gnames)
+	}
+
+	expect := [][]string{{"a", "c"}, {"b"}, {"d"}}
+	if !reflect.DeepEqual(names, expect) {
+		t.Errorf("groups: got %v, expect %v", names, expect)
+	}
+}
+
+func TestGroupValidate(t *testing.T) {
+	var tests = []struct {
+		vols []*SnapVolume
+		ok   bool
+	}{
+		{[]*SnapVolume{{Zfs: "tank/a"}}, true},
+		{[]*SnapVolume{{Zfs: "tank/a"}, {Zfs: "tank/b/c"}}, true},
+		{[]*SnapVolume{{Zfs: "tank/a"}, {Zfs: "other/b"}}, false},
+		{[]*SnapVolume{{Zfs: "tank/a", Recursive: true}, {Zfs: "tank/b"}}, false},
+		{[]*SnapVolume{{Zfs: "tank/a", Recursive: true}, {Zfs: "tank/b", Recursive: true}}, true},
+	}
+
+	for _, tt := range tests {
+		g := &SnapGroup{Name: "test", Vols: tt.vols}
+		err := g.validate()
+		if (err == nil) != tt.ok {
+			t.Errorf("validate %v: got %v, expect ok=%v", tt.vols, err, tt.ok)
+		}
+	}
+}
+
+// hookLog sets up hooks that record each run into a file, returning
+// the hooks and a function to read back the log.
+func hookLog(t *testing.T, dir, who string, failPre bool) (SnapHooks, func() []string) {
+	log := filepath.Join(dir, "log")
+	record := func(kind string) string {
+		return "echo " + kind + "-" + who + " $GACK_VOLUME >> " + log
+	}
+	hooks := SnapHooks{
+		PreSnap:   record("pre"),
+		PostSnap:  record("post"),
+		OnFailure: record("failure"),
+	}
+	if failPre {
+		hooks.PreSnap += "; false"
+	}
+	return hooks, func() []string {
+		data, err := ioutil.ReadFile(log)
+		if err != nil && !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		return strings.Split(strings.TrimSpace(string(data)), "\n")
+	}
+}
+
+func TestHookOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gack-hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	convHooks, _ := hookLog(t, dir, "conv", false)
+	volHooks, read := hookLog(t, dir, "vol", false)
+	h := &hookRunner{
+		vol:  &SnapVolume{Name: "a", Zfs: "tank/a", Hooks: volHooks},
+		conv: &SnapConvention{Name: "hourly", Hooks: convHooks},
+		snap: "hourly-201801021530",
+	}
+
+	if err := h.pre(); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.post(); err != nil {
+		t.Fatal(err)
+	}
+	expect := []string{"pre-conv a", "pre-vol a", "post-vol a", "post-conv a"}
+	if got := read(); !reflect.DeepEqual(got, expect) {
+		t.Errorf("hooks: got %v, expect %v", got, expect)
+	}
+}
+
+func TestGroupHookFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gack-hooks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The pre hook of the second volume fails, so no snapshot is
+	// taken.  Both volumes see the failure, and the post hooks of
+	// both run, in reverse order.  The third volume's hooks never
+	// start.
+	hooks, read := hookLog(t, dir, "vol", false)
+	failing, _ := hookLog(t, dir, "vol", true)
+	conv := &SnapConvention{Name: "hourly"}
+	g := &SnapGroup{
+		Name: "tank",
+		Vols: []*SnapVolume{
+			{Name: "a", Zfs: "tank/a", Hooks: hooks},
+			{Name: "b", Zfs: "tank/b", Hooks: failing},
+			{Name: "c", Zfs: "tank/c", Hooks: hooks},
+		},
+		Convs: []*SnapConvention{conv, conv, conv},
+	}
+
+	err = g.Snap(time.Date(2018, 1, 2, 15, 30, 0, 0, time.UTC))
+	if err == nil {
+		t.Fatal("expected pre hook failure")
+	}
+
+	expect := []string{
+		"pre-vol a", "pre-vol b",
+		"failure-vol a", "failure-vol b",
+		"post-vol b", "post-vol a",
+	}
+	if got := read(); !reflect.DeepEqual(got, expect) {
+		t.Errorf("hooks: got %v, expect %v", got, expect)
+	}
+}
+
+func TestStartsBucket(t *testing.T) {
+	last := time.Date(2018, 7, 4, 23, 0, 0, 0, time.UTC)
+	sameDay := last.Add(30 * time.Minute)
+	nextDay := last.Add(90 * time.Minute)
+
+	var tests = []struct {
+		r      Retention
+		now    time.Time
+		starts bool
+	}{
+		{Retention{}, nextDay, false},
+		{Retention{Hourly: 24}, nextDay, false},
+		{Retention{Daily: 7}, sameDay, false},
+		{Retention{Daily: 7}, nextDay, true},
+		{Retention{WithinDaily: 7 * 24 * time.Hour}, sameDay, false},
+		{Retention{WithinDaily: 7 * 24 * time.Hour}, nextDay, true},
+		{Retention{WithinYearly: 24 * time.Hour}, nextDay, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.r.startsBucket(last, tt.now); got != tt.starts {
+			t.Errorf("%+v at %s: got %t, expect %t", tt.r, tt.now, got, tt.starts)
+		}
+	}
+}
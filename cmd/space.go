@@ -0,0 +1,262 @@
+// Copyright © 2018 David Brown <davidb@davidb.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"davidb.org/x/gack/zfs"
+)
+
+// A SnapPool sets a free space target for a pool.  After applying the
+// convention, prune will remove additional snapshots, oldest first,
+// until the pool is estimated to have at least that much free.
+// Snapshots that are the newest, held by a consumer, held with "zfs
+// hold", or needed for the convention's MinKeep are never removed.
+type SnapPool struct {
+	// Name is the pool, written as a volume's Zfs would be, so
+	// "host:pool" for a remote pool.
+	Name string
+
+	// Free is the target, either a percentage of the pool's size
+	// ("20%"), or a size ("500G").
+	Free string
+}
+
+// findPool returns the pool configured for the given volume, or nil
+// if it has no free space target.
+func findPool(zfsName string) *SnapPool {
+	path := zfs.ParsePath(zfsName)
+	pools := GackConfig.Snap.Pools
+	for i := range pools {
+		if zfs.SamePool(path, zfs.ParsePath(pools[i].Name)) {
+			return &pools[i]
+		}
+	}
+	return nil
+}
+
+// A poolSpace is the space of a pool, read once at the start of a
+// prune.  ZFS frees the space of destroyed snapshots in the
+// background, so reading "available" again after pruning one volume
+// wouldn't yet show what was removed.  Instead, what earlier volumes
+// in the same pool are removing is added up in estimate.
+type poolSpace struct {
+	ds       *zfs.DataSet
+	avail    int64
+	used     int64
+	estimate int64
+}
+
+// poolSpaces holds the space of each pool seen during this run, by
+// the pool's name from the config.
+var poolSpaces = make(map[string]*poolSpace)
+
+// getPoolSpace returns the space of the given pool, which contains
+// the dataset, reading it on first use.
+func getPoolSpace(pool *SnapPool, ds *zfs.DataSet) (*poolSpace, error) {
+	if space, ok := poolSpaces[pool.Name]; ok {
+		return space, nil
+	}
+
+	// The space is measured at the top of the pool.
+	space := &poolSpace{
+		ds: &zfs.DataSet{
+			Path: ds.Path,
+			Name: zfs.Pool(ds.Path),
+		},
+	}
+	var err error
+	space.avail, err = getSize(space.ds, "available")
+	if err != nil {
+		return nil, err
+	}
+	space.used, err = getSize(space.ds, "used")
+	if err != nil {
+		return nil, err
+	}
+
+	poolSpaces[pool.Name] = space
+	return space, nil
+}
+
+// A spaceCheck tracks the space in a pool across a prune.
+type spaceCheck struct {
+	pool  *SnapPool
+	space *poolSpace
+}
+
+// applySpace removes additional snapshots from the plan, if needed to
+// reach the free space target of the volume's pool.  Returns nil if
+// the volume's pool has no target.
+func (v *SnapVolume) applySpace(ds *zfs.DataSet, conv *SnapConvention, plan []*pruneDecision) (*spaceCheck, error) {
+	pool := findPool(v.Zfs)
+	if pool == nil {
+		return nil, nil
+	}
+
+	space, err := getPoolSpace(pool, ds)
+	if err != nil {
+		return nil, err
+	}
+	avail := space.avail + space.estimate
+
+	var target int64
+	if strings.HasSuffix(pool.Free, "%") {
+		pct, err := strconv.ParseFloat(strings.TrimSuffix(pool.Free, "%"), 64)
+		if err != nil {
+			return nil, fmt.Errorf("Pool %q: invalid free %q", pool.Name, pool.Free)
+		}
+		target = int64(pct / 100 * float64(space.avail+space.used))
+	} else {
+		target, err = parseSize(pool.Free)
+		if err != nil {
+			return nil, fmt.Errorf("Pool %q: invalid free %q", pool.Name, pool.Free)
+		}
+	}
+
+	props, err := ds.SnapProps("used", "userrefs")
+	if err != nil {
+		return nil, err
+	}
+	sizeOf := func(name string) int64 {
+		// The snapshot may have been removed since it was
+		// listed.
+		if props[name] == nil {
+			return 0
+		}
+		n, _ := strconv.ParseInt(props[name][0], 10, 64)
+		return n
+	}
+
+	// Estimate what the convention is already removing.  The used
+	// space of a snapshot only counts what is unique to it, so this
+	// is an underestimate.
+	check := &spaceCheck{
+		pool:  pool,
+		space: space,
+	}
+	kept := 0
+	var estimate int64
+	for _, dec := range plan {
+		if dec.Keep {
+			kept++
+		} else {
+			estimate += sizeOf(dec.Name)
+		}
+	}
+	defer func() {
+		space.estimate += estimate
+	}()
+
+	needed := target - avail - estimate
+	if needed <= 0 {
+		return check, nil
+	}
+
+	fmt.Fprintf(pruneLog(), "Pool %q has %s free, target %s\n", pool.Name,
+		formatSize(avail), formatSize(target))
+
+	for i := len(plan) - 1; i >= 0 && needed > 0; i-- {
+		dec := plan[i]
+		if !dec.Keep || dec.pinned || kept <= conv.MinKeep {
+			continue
+		}
+		if props[dec.Name] == nil || props[dec.Name][1] != "0" {
+			// Held with "zfs hold".
+			continue
+		}
+
+		dec.Keep = false
+		dec.Reasons = []string{fmt.Sprintf("space on pool %q", pool.Name)}
+		kept--
+		size := sizeOf(dec.Name)
+		estimate += size
+		needed -= size
+	}
+
+	if needed > 0 {
+		fmt.Fprintf(pruneLog(), "Pool %q: unable to find %s more to remove\n", pool.Name,
+			formatSize(needed))
+	}
+
+	return check, nil
+}
+
+// report shows how much space has been reclaimed in the pool so far
+// in this prune.  As ZFS frees space in the background, this may lag
+// behind the estimate.
+func (c *spaceCheck) report() error {
+	avail, err := getSize(c.space.ds, "available")
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Pool %q: reclaimed %s (estimated %s), %s free\n", c.pool.Name,
+		formatSize(avail-c.space.avail), formatSize(c.space.estimate), formatSize(avail))
+	return nil
+}
+
+// getSize returns a numeric property of a dataset.
+func getSize(ds *zfs.DataSet, prop string) (int64, error) {
+	text, err := ds.GetProp(prop)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(text, 10, 64)
+}
+
+var sizeSuffixes = "KMGTPE"
+
+// parseSize parses a size, with an optional binary suffix, such as
+// "500G" or "1.5TiB".
+func parseSize(text string) (int64, error) {
+	text = strings.ToUpper(strings.TrimSpace(text))
+	if strings.HasSuffix(text, "IB") {
+		text = strings.TrimSuffix(text, "IB")
+	} else {
+		text = strings.TrimSuffix(text, "B")
+	}
+
+	mult := int64(1)
+	if n := len(text); n > 0 {
+		if pos := strings.IndexByte(sizeSuffixes, text[n-1]); pos >= 0 {
+			mult = int64(1) << (10 * uint(pos+1))
+			text = text[:n-1]
+		}
+	}
+
+	value, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return 0, err
+	}
+	return int64(value * float64(mult)), nil
+}
+
+// formatSize formats a size in bytes with a binary suffix.
+func formatSize(size int64) string {
+	value := float64(size)
+	suffix := ""
+	for i := 0; i < len(sizeSuffixes) && (value >= 1024 || value <= -1024); i++ {
+		value /= 1024
+		suffix = sizeSuffixes[i : i+1]
+	}
+	if suffix == "" {
+		return fmt.Sprintf("%dB", size)
+	}
+	return fmt.Sprintf("%.1f%siB", value, suffix)
+}
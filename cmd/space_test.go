@@ -0,0 +1,53 @@
+package cmd
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	var tests = []struct {
+		text string
+		size int64
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"1234", 1234, true},
+		{"512B", 512, true},
+		{"4k", 4096, true},
+		{"500G", 500 << 30, true},
+		{"1.5T", 3 << 39, true},
+		{"2GiB", 2 << 30, true},
+		{" 10M ", 10 << 20, true},
+		{"", 0, false},
+		{"G", 0, false},
+		{"10X", 0, false},
+	}
+
+	for _, tt := range tests {
+		size, err := parseSize(tt.text)
+		if (err == nil) != tt.ok || (tt.ok && size != tt.size) {
+			t.Errorf("parseSize(%q): got %d, %v, want %d", tt.text, size, err, tt.size)
+		}
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	var tests = []struct {
+		size int64
+		text string
+	}{
+		{0, "0B"},
+		{100, "100B"},
+		{1023, "1023B"},
+		{1024, "1.0KiB"},
+		{1536, "1.5KiB"},
+		{500 << 30, "500.0GiB"},
+		{3 << 39, "1.5TiB"},
+		{-2048, "-2.0KiB"},
+	}
+
+	for _, tt := range tests {
+		text := formatSize(tt.size)
+		if text != tt.text {
+			t.Errorf("formatSize(%d): got %q, want %q", tt.size, text, tt.text)
+		}
+	}
+}
@@ -17,10 +17,8 @@ package cmd
 import (
 	"fmt"
 	"os"
-	"path/filepath"
 	"regexp"
 
-	"davidb.org/x/gack/zfs"
 	"davidb.org/x/gosure"
 	"davidb.org/x/gosure/status"
 	"davidb.org/x/gosure/store"
@@ -58,7 +56,7 @@ type SureVolume struct {
 	Sure       string
 	Convention string
 
-	mount string
+	snaps SnapProvider
 }
 
 func init() {
@@ -72,13 +70,8 @@ func (sv *SureVolume) SureSync() error {
 	stats := status.NewManager()
 	defer stats.Close()
 
-	path := zfs.ParsePath(sv.Zfs)
-	dss, err := zfs.GetSnaps(path)
-	if err != nil {
-		return err
-	}
-
-	sv.mount, err = FindMount(sv.Zfs, "zfs")
+	var err error
+	sv.snaps, err = OpenSnapProvider(sv.Zfs)
 	if err != nil {
 		return err
 	}
@@ -86,10 +79,13 @@ func (sv *SureVolume) SureSync() error {
 	// Filter the snaps to those of the given convention.
 	var snaps []string
 
-	re := regexp.MustCompile("^" + regexp.QuoteMeta(sv.Convention) + `(\d|-)?`)
+	match, err := sv.matcher()
+	if err != nil {
+		return err
+	}
 
-	for _, sn := range dss[0].Snaps {
-		if re.MatchString(sn) {
+	for _, sn := range sv.snaps.Snaps() {
+		if match(sn) {
 			snaps = append(snaps, sn)
 		}
 	}
@@ -136,6 +132,26 @@ func (sv *SureVolume) SureSync() error {
 	return nil
 }
 
+// matcher returns a function that determines if a snapshot belongs
+// to this volume's convention.  If the convention isn't configured,
+// just match on the name prefix.
+func (sv *SureVolume) matcher() (func(string) bool, error) {
+	conv := findConvention(sv.Convention)
+	if conv == nil {
+		re := regexp.MustCompile("^" + regexp.QuoteMeta(sv.Convention) + `(\d|-)?`)
+		return re.MatchString, nil
+	}
+
+	err := conv.setup()
+	if err != nil {
+		return nil, err
+	}
+	return func(sn string) bool {
+		_, ok := conv.parseSnap(sn)
+		return ok
+	}, nil
+}
+
 // ContainsSnap inciates if this header contain the given snapshot?
 func (sv *SureVolume) ContainsSnap(st *store.Store, hdr *weave.Header, snap string) bool {
 	for _, d := range hdr.Deltas {
@@ -157,16 +173,13 @@ func (sv *SureVolume) Scan(st *store.Store, snap string, mgr *status.Manager) er
 		return nil
 	}
 
-	scanDir := filepath.Join(sv.mount, ".zfs", "snapshot", snap)
-
-	// Stat within the snapshot for the ZFS automounter to mount
-	// it.
-	_, err := os.Lstat(scanDir + "/.")
+	sn, err := sv.snaps.Materialize(snap, "")
 	if err != nil {
 		return err
 	}
+	defer sn.Release()
 
-	err = gosure.Scan(st, scanDir, mgr)
+	err = gosure.Scan(st, sn.Dir, mgr)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,110 @@
+// Copyright © 2018 David Brown <davidb@davidb.org>
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// checkedVersions remembers the programs whose version has already
+// been checked against a minimum, so that each is only run once.
+var checkedVersions = make(map[string]error)
+
+// checkVersion ensures that the given program is at least version
+// min.  The version is queried with the given function the first time
+// a program is checked against each minimum.
+func checkVersion(prog, min string, version func() (string, error)) error {
+	key := prog + " " + min
+	if err, ok := checkedVersions[key]; ok {
+		return err
+	}
+
+	ver, err := version()
+	if err != nil {
+		err = fmt.Errorf("Unable to determine version of %q: %s", prog, err)
+	} else if versionLess(ver, min) {
+		err = fmt.Errorf("%q is version %s, but at least %s is required",
+			prog, ver, min)
+	}
+
+	checkedVersions[key] = err
+	return err
+}
+
+// checkTools checks, before any work is done, that the programs used
+// by the configured borg and/or restic volumes are recent enough.
+// Setting up each volume's repository checks its program.
+func checkTools(borg, restic bool) error {
+	if borg {
+		for i := range GackConfig.Borg.Volumes {
+			err := GackConfig.Borg.Volumes[i].openRepo()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if restic {
+		for i := range GackConfig.Restic.Volumes {
+			err := GackConfig.Restic.Volumes[i].openRepo()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// versionLess returns true if version a is older than version b.
+// Versions are compared numerically by dotted component, ignoring
+// any suffix such as "rc1" or "-dev".
+func versionLess(a, b string) bool {
+	as := versionParts(a)
+	bs := versionParts(b)
+
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x = as[i]
+		}
+		if i < len(bs) {
+			y = bs[i]
+		}
+		if x != y {
+			return x < y
+		}
+	}
+	return false
+}
+
+func versionParts(v string) []int {
+	var parts []int
+	for _, field := range strings.Split(v, ".") {
+		end := 0
+		for end < len(field) && field[end] >= '0' && field[end] <= '9' {
+			end++
+		}
+		n, err := strconv.Atoi(field[:end])
+		if err != nil {
+			break
+		}
+		parts = append(parts, n)
+		if end < len(field) {
+			break
+		}
+	}
+	return parts
+}
@@ -51,7 +51,7 @@ func (ts *tstate) makeTree() {
 	ts.run("cp", "-r", ".", "/"+testBase+"/fs")
 
 	now := time.Now()
-	err := snapconf.Volumes[0].Snap(now)
+	err := snapconf.Volumes[0].Snap(&snapconf.Conventions[0], now)
 	if err != nil {
 		ts.t.Fatal(err)
 	}
@@ -63,7 +63,7 @@ func (ts *tstate) makeTree() {
 	}
 
 	now = now.Add(5 * time.Minute)
-	err = snapconf.Volumes[0].Snap(now)
+	err = snapconf.Volumes[0].Snap(&snapconf.Conventions[0], now)
 	if err != nil {
 		ts.t.Fatal(err)
 	}
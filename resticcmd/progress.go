@@ -0,0 +1,175 @@
+package resticcmd // import "davidb.org/x/gack/resticcmd"
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// Progress is reported periodically while restic makes a backup.
+type Progress struct {
+	PercentDone float64  `json:"percent_done"`
+	TotalFiles  int64    `json:"total_files"`
+	FilesDone   int64    `json:"files_done"`
+	TotalBytes  int64    `json:"total_bytes"`
+	BytesDone   int64    `json:"bytes_done"`
+	CurrentFile []string `json:"current_files"`
+}
+
+// Stats are the statistics of a completed backup.  DataAdded is how
+// much was added to the repository.  Errors are the files that
+// couldn't be backed up.
+type Stats struct {
+	FilesNew            int64
+	FilesChanged        int64
+	FilesUnmodified     int64
+	TotalFilesProcessed int64
+	TotalBytesProcessed int64
+	DataAdded           int64
+	Duration            time.Duration
+	SnapshotID          string
+	Errors              []*FileError
+}
+
+// A FileError is a file that restic was unable to back up.
+type FileError struct {
+	Item    string
+	During  string
+	Message string
+}
+
+func (e *FileError) Error() string {
+	return fmt.Sprintf("%s during %s: %s", e.Item, e.During, e.Message)
+}
+
+// A message is a line of output from "restic backup --json".
+type message struct {
+	MessageType string `json:"message_type"`
+	Progress
+
+	FilesNew            int64   `json:"files_new"`
+	FilesChanged        int64   `json:"files_changed"`
+	FilesUnmodified     int64   `json:"files_unmodified"`
+	TotalFilesProcessed int64   `json:"total_files_processed"`
+	TotalBytesProcessed int64   `json:"total_bytes_processed"`
+	DataAdded           int64   `json:"data_added"`
+	TotalDuration       float64 `json:"total_duration"`
+	SnapshotID          string  `json:"snapshot_id"`
+
+	Error  json.RawMessage `json:"error"`
+	During string          `json:"during"`
+	Item   string          `json:"item"`
+}
+
+// errorMessage returns the text of the error in an error message.
+// Newer versions of restic give this as {"message": text}, older ones
+// as the fields of the error, which are shown as they are.
+func (m *message) errorMessage() string {
+	var e struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(m.Error, &e) == nil && e.Message != "" {
+		return e.Message
+	}
+	return string(m.Error)
+}
+
+// runBackupJSON runs a "restic backup --json" command, passing
+// progress to the given function (if not nil).  Restic writes errors
+// to stderr, so both outputs are read.  Returns the statistics from
+// the summary.  If restic fails only because some files couldn't be
+// read, the snapshot is still made, and those files are in the
+// statistics' Errors.
+func runBackupJSON(cmd *exec.Cmd, progress func(*Progress)) (*Stats, error) {
+	rd, wr, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+	cmd.Stdout = wr
+	cmd.Stderr = wr
+
+	err = cmd.Start()
+	wr.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	stats, err := scanBackupJSON(rd, progress, os.Stderr)
+	if err != nil {
+		// Keep reading, so the command isn't blocked writing
+		// to the pipe.
+		io.Copy(ioutil.Discard, rd)
+		cmd.Wait()
+		return nil, err
+	}
+
+	err = cmd.Wait()
+	if err != nil && (stats == nil || stats.SnapshotID == "" || len(stats.Errors) == 0) {
+		return nil, err
+	}
+
+	if stats == nil {
+		return nil, errors.New("restic backup gave no summary")
+	}
+	return stats, nil
+}
+
+// scanBackupJSON reads the output of "restic backup --json", passing
+// progress to the given function (if not nil), and errors and
+// anything that isn't json to log.  Returns the statistics from the
+// summary, or nil if there wasn't one.
+func scanBackupJSON(rd io.Reader, progress func(*Progress), log io.Writer) (*Stats, error) {
+	var stats *Stats
+	var fileErrors []*FileError
+	scan := bufio.NewScanner(rd)
+	scan.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scan.Scan() {
+		var msg message
+		if json.Unmarshal(scan.Bytes(), &msg) != nil {
+			// Pass through anything that isn't json.
+			fmt.Fprintf(log, "%s\n", scan.Bytes())
+			continue
+		}
+
+		switch msg.MessageType {
+		case "status":
+			if progress != nil {
+				progress(&msg.Progress)
+			}
+		case "error":
+			ferr := &FileError{
+				Item:    msg.Item,
+				During:  msg.During,
+				Message: msg.errorMessage(),
+			}
+			fmt.Fprintf(log, "restic error: %s\n", ferr)
+			fileErrors = append(fileErrors, ferr)
+		case "summary":
+			stats = &Stats{
+				FilesNew:            msg.FilesNew,
+				FilesChanged:        msg.FilesChanged,
+				FilesUnmodified:     msg.FilesUnmodified,
+				TotalFilesProcessed: msg.TotalFilesProcessed,
+				TotalBytesProcessed: msg.TotalBytesProcessed,
+				DataAdded:           msg.DataAdded,
+				Duration:            time.Duration(msg.TotalDuration * float64(time.Second)),
+				SnapshotID:          msg.SnapshotID,
+			}
+		}
+	}
+	if err := scan.Err(); err != nil {
+		return nil, err
+	}
+
+	if stats != nil {
+		stats.Errors = fileErrors
+	}
+	return stats, nil
+}
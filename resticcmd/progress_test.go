@@ -0,0 +1,81 @@
+package resticcmd
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Output recorded from "restic backup --json", with both stdout and
+// stderr.
+const (
+	statusLine = `{"message_type":"status","percent_done":0.5,"total_files":10,"files_done":5,"total_bytes":2048,"bytes_done":1024,"current_files":["/data/b"]}`
+
+	summaryLine = `{"message_type":"summary","files_new":3,"files_changed":1,"files_unmodified":6,"dirs_new":0,"dirs_changed":1,"dirs_unmodified":2,"data_blobs":4,"tree_blobs":2,"data_added":4096,"total_files_processed":10,"total_bytes_processed":2048,"total_duration":1.5,"snapshot_id":"4f1c2d3e"}`
+
+	errorLine = `{"message_type":"error","error":{"message":"open /data/secret: permission denied"},"during":"archival","item":"/data/secret"}`
+
+	oldErrorLine = `{"message_type":"error","error":{"Op":"lstat","Path":"/data/gone","Err":2},"during":"scan","item":"/data/gone"}`
+)
+
+func TestScanBackupJSON(t *testing.T) {
+	summary := &Stats{
+		FilesNew:            3,
+		FilesChanged:        1,
+		FilesUnmodified:     6,
+		TotalFilesProcessed: 10,
+		TotalBytesProcessed: 2048,
+		DataAdded:           4096,
+		Duration:            1500 * time.Millisecond,
+		SnapshotID:          "4f1c2d3e",
+	}
+	withErrors := *summary
+	withErrors.Errors = []*FileError{
+		{Item: "/data/secret", During: "archival", Message: "open /data/secret: permission denied"},
+		{Item: "/data/gone", During: "scan", Message: `{"Op":"lstat","Path":"/data/gone","Err":2}`},
+	}
+
+	var tests = []struct {
+		name     string
+		lines    []string
+		stats    *Stats
+		progress int
+		log      string
+	}{
+		{"clean", []string{statusLine, statusLine, summaryLine}, summary, 2, ""},
+		{"errors", []string{statusLine, errorLine, oldErrorLine, summaryLine}, &withErrors, 1,
+			"restic error: /data/secret during archival: open /data/secret: permission denied\n" +
+				`restic error: /data/gone during scan: {"Op":"lstat","Path":"/data/gone","Err":2}` + "\n"},
+		{"text", []string{"using parent snapshot 1a2b3c4d", summaryLine}, summary, 0,
+			"using parent snapshot 1a2b3c4d\n"},
+		{"no summary", []string{statusLine, "Fatal: unable to open repository"}, nil, 1,
+			"Fatal: unable to open repository\n"},
+	}
+
+	for _, tt := range tests {
+		var log bytes.Buffer
+		progress := 0
+		stats, err := scanBackupJSON(strings.NewReader(strings.Join(tt.lines, "\n")+"\n"),
+			func(p *Progress) {
+				progress++
+				if p.FilesDone != 5 || p.BytesDone != 1024 {
+					t.Errorf("%s: progress %+v", tt.name, p)
+				}
+			}, &log)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(stats, tt.stats) {
+			t.Errorf("%s: stats got %+v, want %+v", tt.name, stats, tt.stats)
+		}
+		if progress != tt.progress {
+			t.Errorf("%s: progress called %d times, want %d", tt.name, progress, tt.progress)
+		}
+		if log.String() != tt.log {
+			t.Errorf("%s: log got %q, want %q", tt.name, log.String(), tt.log)
+		}
+	}
+}
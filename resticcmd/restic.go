@@ -4,10 +4,16 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"strings"
 	"time"
 )
 
-const resticCmd = "/home/davidb/go/bin/restic"
+// The default restic program, found through PATH.
+const resticCmd = "restic"
+
+// MinVersion is the oldest version of restic supported, which is the
+// first with json output from backup.
+const MinVersion = "0.9.5"
 
 // The subset of information from the restic snapshots command we care
 // about.
@@ -30,19 +36,78 @@ func (s *Snapshot) HasPath(path string) bool {
 	return false
 }
 
+// HasTag returns true if the snapshot has the given tag.
+func (s *Snapshot) HasTag(tag string) bool {
+	for _, t := range s.Tags {
+		if t == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
 type Repo struct {
 	Path         string
 	Passwordfile string
+
+	// Command is the restic program to run, defaulting to
+	// resticCmd.  Args are given to every restic command, and Env
+	// ("NAME=value") are added to the environment of every restic
+	// command.
+	Command string
+	Args    []string
+	Env     []string
+}
+
+// command builds a restic command for this repository with the given
+// arguments.
+func (r *Repo) command(args ...string) *exec.Cmd {
+	cmd := exec.Command(r.program(), "-r", r.Path, "-p", r.Passwordfile)
+	cmd.Args = append(cmd.Args, r.Args...)
+	cmd.Args = append(cmd.Args, args...)
+	if len(r.Env) > 0 {
+		cmd.Env = append(os.Environ(), r.Env...)
+	}
+	return cmd
+}
+
+// program returns the restic program to run.
+func (r *Repo) program() string {
+	if r.Command == "" {
+		return resticCmd
+	}
+	return r.Command
+}
+
+// Version returns the version of restic, such as "0.9.1".  Only the
+// program and environment are used, as Args are meant for commands
+// on the repository.
+func (r *Repo) Version() (string, error) {
+	cmd := exec.Command(r.program(), "version")
+	if len(r.Env) > 0 {
+		cmd.Env = append(os.Environ(), r.Env...)
+	}
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+
+	// The output is of the form "restic 0.9.1 compiled with ...".
+	fields := strings.Fields(string(out))
+	if len(fields) < 2 || fields[0] != "restic" {
+		return "", fmt.Errorf("Unexpected restic version output: %q", string(out))
+	}
+	return fields[1], nil
 }
 
 // GetSnapshots runs restic to determine the available commands.
 func (r *Repo) GetSnapshots() ([]*Snapshot, error) {
-	out, err := exec.Command(resticCmd, "-r", r.Path, "-p",
-		r.Passwordfile, "snapshots", "--json").Output()
+	out, err := r.command("snapshots", "--json").Output()
 	if err != nil {
 		return nil, err
 	}
-	fmt.Printf("%d bytes of output\n", len(out))
 
 	var snaps []*Snapshot
 	err = json.Unmarshal(out, &snaps)
@@ -53,17 +118,110 @@ func (r *Repo) GetSnapshots() ([]*Snapshot, error) {
 	return snaps, nil
 }
 
-// RunBackup requests a backup, of the given tags and mountpoint.
-func (r *Repo) RunBackup(source string, tags []string) error {
-	cmd := exec.Command(resticCmd, "-r", r.Path, "-p", r.Passwordfile,
-		"backup", "--exclude-caches")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+// BackupOptions gives the details of a single restic backup.
+type BackupOptions struct {
+	// Tags are added to the snapshot.
+	Tags []string
+
+	// Time, if not zero, is recorded as the time of the snapshot,
+	// instead of the current time.
+	Time time.Time
+
+	// Parent, if not empty, is the ID of the snapshot to compare
+	// against, instead of letting restic choose one.  Files that
+	// are unchanged from the parent aren't read.
+	Parent string
+}
 
-	for _, t := range tags {
+// RunBackup requests a backup of the given mountpoint.  Progress is
+// passed to the progress function, if not nil, and the statistics of
+// the backup are returned.
+func (r *Repo) RunBackup(source string, opts *BackupOptions,
+	progress func(*Progress)) (*Stats, error) {
+	cmd := r.command("backup", "--json", "--exclude-caches")
+
+	for _, t := range opts.Tags {
 		cmd.Args = append(cmd.Args, "--tag", t)
 	}
+	if !opts.Time.IsZero() {
+		cmd.Args = append(cmd.Args, "--time",
+			opts.Time.Local().Format("2006-01-02 15:04:05"))
+	}
+	if opts.Parent != "" {
+		cmd.Args = append(cmd.Args, "--parent", opts.Parent)
+	}
 	cmd.Args = append(cmd.Args, source)
 
+	return runBackupJSON(cmd, progress)
+}
+
+// A ForgetGroup is a group of snapshots, as reported by "restic forget
+// --json", with the snapshots that are kept and removed.
+type ForgetGroup struct {
+	Tags   []string    `json:"tags"`
+	Host   string      `json:"host"`
+	Paths  []string    `json:"paths"`
+	Keep   []*Snapshot `json:"keep"`
+	Remove []*Snapshot `json:"remove"`
+}
+
+// Forget runs "restic forget" with the given arguments, which give the
+// policy, and select and group the snapshots.  If dryRun is true,
+// nothing is removed, but the groups still report what would be.
+func (r *Repo) Forget(args []string, dryRun bool) ([]*ForgetGroup, error) {
+	cmd := r.command("forget", "--json")
+	if dryRun {
+		cmd.Args = append(cmd.Args, "--dry-run")
+	}
+	cmd.Args = append(cmd.Args, args...)
+	cmd.Stderr = os.Stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []*ForgetGroup
+	err = json.Unmarshal(out, &groups)
+	if err != nil {
+		return nil, err
+	}
+
+	return groups, nil
+}
+
+// Check verifies the structure of the repository.  If readData is
+// true, all of the data is read and verified as well.  Otherwise, if
+// subset is not empty, it is passed to --read-data-subset (such as
+// "2/10") to read part of the data.
+func (r *Repo) Check(readData bool, subset string) error {
+	cmd := r.command("check")
+	if readData {
+		cmd.Args = append(cmd.Args, "--read-data")
+	} else if subset != "" {
+		cmd.Args = append(cmd.Args, "--read-data-subset="+subset)
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return cmd.Run()
+}
+
+// Prune removes the data no longer referenced by any snapshot.
+func (r *Repo) Prune() error {
+	cmd := r.command("prune")
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return cmd.Run()
+}
+
+// Tag adds a tag to each of the given snapshots.
+func (r *Repo) Tag(tag string, ids []string) error {
+	cmd := r.command("tag", "--add", tag)
+	cmd.Args = append(cmd.Args, ids...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
 	return cmd.Run()
 }
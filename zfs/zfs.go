@@ -10,7 +10,10 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // A location where we can run zfs commands.
@@ -21,6 +24,10 @@ type Path interface {
 
 	// Construct a command to run a zfs command on this path.
 	Command(args ...string) *exec.Cmd
+
+	// Construct a command to run a shell script on the host of
+	// this path.  The script can run zfs commands as "$ZFS".
+	Script(script string) *exec.Cmd
 }
 
 // A local ZFS path.  The name refers to a volume accessible locally.
@@ -37,6 +44,12 @@ func (p LocalPath) Command(args ...string) *exec.Cmd {
 	return cmd
 }
 
+func (p LocalPath) Script(script string) *exec.Cmd {
+	cmd := exec.Command("sh", "-c", "ZFS=zfs\n"+script)
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
 // A remote ZFS path.  There is a host and a path involved.
 type RemotePath struct {
 	Host string
@@ -54,6 +67,19 @@ func (p *RemotePath) Command(args ...string) *exec.Cmd {
 	return cmd
 }
 
+func (p *RemotePath) Script(script string) *exec.Cmd {
+	cmd := exec.Command("ssh", p.Host, "sudo", "sh", "-c",
+		ShellQuote("ZFS=/sbin/zfs\n"+script))
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// ShellQuote quotes text so that the shell will treat it as a single
+// word.
+func ShellQuote(text string) string {
+	return "'" + strings.Replace(text, "'", `'\''`, -1) + "'"
+}
+
 // Parse a user-specified zfs descriptor and return the proper path
 // type.  If the path contains a ':' character, the left side will be
 // the host, and the right the path of a remote zfs filesystem,
@@ -161,6 +187,153 @@ func (ds *DataSet) Bookmark(name string) error {
 	return err
 }
 
+// A BatchError reports the snapshots that failed in an operation on
+// many snapshots.  The other snapshots succeeded.
+type BatchError map[string]error
+
+func (e BatchError) Error() string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%d snapshots failed:", len(e))
+	for _, name := range names {
+		fmt.Fprintf(&buf, " %s (%s)", name, e[name])
+	}
+	return buf.String()
+}
+
+// batchSize is the most snapshots given to a single zfs command.
+const batchSize = 200
+
+// BookmarkAll creates bookmarks of the same name for each of the given
+// snapshots, with a single command to the host.  As with Bookmark,
+// already existing bookmarks are not an error.  Failures are returned
+// as a BatchError.
+func (ds *DataSet) BookmarkAll(names []string) error {
+	return ds.scriptEach(names, `"$ZFS" bookmark "$ds@$s" "$ds#$s"`, "bookmark exists")
+}
+
+// RemoveBookmarks removes the given bookmarks, with a single command
+// to the host.  Failures are returned as a BatchError.
+func (ds *DataSet) RemoveBookmarks(names []string) error {
+	return ds.scriptEach(names, `"$ZFS" destroy "$ds#$s"`, "")
+}
+
+// scriptEach runs the given zfs command line for each of the names,
+// using a shell script, so that only one command (and ssh connection
+// for remote paths) is needed for many names.  The command line can
+// refer to the dataset as $ds and the name as $s.  Errors whose
+// message contains ignore (if not empty) are not failures.
+func (ds *DataSet) scriptEach(names []string, command, ignore string) error {
+	failed := make(BatchError)
+
+	for len(names) > 0 {
+		chunk := names
+		if len(chunk) > batchSize {
+			chunk = chunk[:batchSize]
+		}
+		names = names[len(chunk):]
+
+		var script bytes.Buffer
+		fmt.Fprintf(&script, "ds=%s\n", ShellQuote(ds.Name))
+		script.WriteString("for s in")
+		for _, name := range chunk {
+			script.WriteString(" " + ShellQuote(name))
+		}
+		script.WriteString("; do\n")
+		fmt.Fprintf(&script, "  out=$(%s 2>&1) || case \"$out\" in\n", command)
+		if ignore != "" {
+			fmt.Fprintf(&script, "    *%s*) ;;\n", ShellQuote(ignore))
+		}
+		script.WriteString(`    *) printf '%s\t%s\n' "$s" "$(echo $out)" ;;
+  esac
+done
+`)
+
+		cmd := ds.Path.Script(script.String())
+		out, err := cmd.Output()
+		if err != nil {
+			for _, name := range chunk {
+				failed[name] = err
+			}
+			continue
+		}
+
+		sc := bufio.NewScanner(bytes.NewReader(out))
+		for sc.Scan() {
+			fields := strings.SplitN(sc.Text(), "\t", 2)
+			if len(fields) != 2 {
+				continue
+			}
+			failed[fields[0]] = errors.New(fields[1])
+		}
+	}
+
+	if len(failed) > 0 {
+		return failed
+	}
+	return nil
+}
+
+// RemoveSnaps removes the given snapshots, using as few zfs commands
+// as possible.  ZFS removes a list of snapshots atomically, so when a
+// command fails, the list is split to find the snapshots that can't
+// be removed.  Failures are returned as a BatchError.  If recursive is
+// true, the snapshots are also removed from descendent filesystems.
+func (ds *DataSet) RemoveSnaps(names []string, recursive bool) error {
+	failed := make(BatchError)
+
+	for len(names) > 0 {
+		chunk := names
+		if len(chunk) > batchSize {
+			chunk = chunk[:batchSize]
+		}
+		names = names[len(chunk):]
+
+		ds.removeChunk(chunk, recursive, failed)
+	}
+
+	if len(failed) > 0 {
+		return failed
+	}
+	return nil
+}
+
+// removeChunk removes the given snapshots with a single command,
+// splitting the chunk if that fails.
+func (ds *DataSet) removeChunk(names []string, recursive bool, failed BatchError) {
+	args := []string{"destroy"}
+	if recursive {
+		args = append(args, "-r")
+	}
+	args = append(args, ds.Name+"@"+strings.Join(names, ","))
+
+	var stderr bytes.Buffer
+	cmd := ds.Path.Command(args...)
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err == nil {
+		return
+	}
+
+	if len(names) == 1 {
+		msg := strings.TrimSpace(stderr.String())
+		if msg != "" {
+			err = errors.New(msg)
+		}
+		failed[names[0]] = err
+		return
+	}
+
+	half := len(names) / 2
+	ds.removeChunk(names[:half], recursive, failed)
+	ds.removeChunk(names[half:], recursive, failed)
+}
+
 // RemoveSnap removes a snapshot.
 func (ds *DataSet) RemoveSnap(name string) error {
 	cmd := ds.Path.Command("destroy", ds.Name+"@"+name)
@@ -173,6 +346,134 @@ func (ds *DataSet) AddSnap(name string) error {
 	return cmd.Run()
 }
 
+// Snapshot creates all of the given snapshots (full names, of the
+// form filesystem@snap) with a single command, which ZFS performs
+// atomically.  All of the snapshots must be in the same pool,
+// accessible through path.  If recursive is true, all descendent
+// filesystems are snapshotted as well.
+func Snapshot(path Path, recursive bool, names ...string) error {
+	args := []string{"snapshot"}
+	if recursive {
+		args = append(args, "-r")
+	}
+	args = append(args, names...)
+	cmd := path.Command(args...)
+	return cmd.Run()
+}
+
+// Pool returns the name of the pool containing the given path.
+func Pool(p Path) string {
+	return strings.SplitN(p.Name(), "/", 2)[0]
+}
+
+// SamePool returns true if the two paths refer to filesystems in the
+// same pool, on the same host.
+func SamePool(a, b Path) bool {
+	if Pool(a) != Pool(b) {
+		return false
+	}
+
+	switch a := a.(type) {
+	case LocalPath:
+		_, ok := b.(LocalPath)
+		return ok
+	case *RemotePath:
+		b, ok := b.(*RemotePath)
+		return ok && a.Host == b.Host
+	default:
+		return false
+	}
+}
+
+// SnapTimes returns the creation time of each of the snapshots of
+// this dataset.
+func (ds *DataSet) SnapTimes() (map[string]time.Time, error) {
+	props, err := ds.SnapProps("creation")
+	if err != nil {
+		return nil, err
+	}
+
+	times := make(map[string]time.Time)
+	for name, p := range props {
+		secs, err := strconv.ParseInt(p[0], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		times[name] = time.Unix(secs, 0)
+	}
+
+	return times, nil
+}
+
+// SnapProps returns the values of the given properties for each of
+// the snapshots of this dataset, in the same order as the properties
+// were given.  Numeric values are returned as exact numbers.
+func (ds *DataSet) SnapProps(props ...string) (map[string][]string, error) {
+	cmd := ds.Path.Command("list", "-Hp", "-t", "snapshot",
+		"-o", "name,"+strings.Join(props, ","), "-d", "1", ds.Name)
+	buf, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string][]string)
+
+	sc := bufio.NewScanner(bytes.NewReader(buf))
+	for sc.Scan() {
+		fields := strings.Split(sc.Text(), "\t")
+		if len(fields) != len(props)+1 {
+			return nil, fmt.Errorf("Unexpected output from zfs list: %q", sc.Text())
+		}
+
+		vols := strings.SplitN(fields[0], "@", 2)
+		if len(vols) != 2 || vols[0] != ds.Name {
+			return nil, fmt.Errorf("Unexpected snapshot from zfs list: %q", fields[0])
+		}
+
+		result[vols[1]] = fields[1:]
+	}
+	if sc.Err() != nil {
+		return nil, sc.Err()
+	}
+
+	return result, nil
+}
+
+// GetProp returns the value of a single property of this dataset.
+// Numeric values are returned as exact (parsable) numbers.
+func (ds *DataSet) GetProp(prop string) (string, error) {
+	cmd := ds.Path.Command("get", "-Hp", "-o", "value", prop, ds.Name)
+	buf, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(buf), "\n"), nil
+}
+
+// GetPropTree returns the value of a single property of this dataset
+// and each of its descendent filesystems and volumes, indexed by
+// dataset name.  Numeric values are returned as exact numbers.
+func (ds *DataSet) GetPropTree(prop string) (map[string]string, error) {
+	cmd := ds.Path.Command("get", "-rHp", "-t", "filesystem,volume",
+		"-o", "name,value", prop, ds.Name)
+	buf, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimRight(string(buf), "\n"), "\n") {
+		fields := strings.SplitN(line, "\t", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Unexpected output from zfs get: %q", line)
+		}
+		result[fields[0]] = fields[1]
+	}
+
+	return result, nil
+}
+
 // ShortName removes the prefix from this path.  An empty string would
 // be equivalent to the path.  Returns an error if the name doesn't
 // match the prefix.